@@ -4,8 +4,9 @@ go 1.24.0
 
 require (
 	github.com/andybalholm/brotli v1.1.0
+	github.com/evanphx/json-patch/v5 v5.9.11
 	github.com/gorilla/mux v1.8.1
 	github.com/joho/godotenv v1.5.1
 	github.com/klauspost/compress v1.17.8
-
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -8,6 +8,8 @@ import (
 	"net/http"
 	"remnawave-json/internal/config"
 	"remnawave-json/internal/transport/rest"
+	"remnawave-json/internal/useragent"
+	"sort"
 	"strings"
 	"time"
 
@@ -17,14 +19,20 @@ import (
 var server *http.Server
 
 func Start() {
+	rules := config.GetUserAgentRules()
+	if err := validateUserAgentRules(rules); err != nil {
+		slog.Error("Invalid user agent rules")
+		panic(err)
+	}
+
 	r := mux.NewRouter()
 
 	r.Use(httpsAndProxyMiddleware)
 
-	r.HandleFunc("/{shortUuid}", userAgentRouter()).Methods(http.MethodGet)
-	r.HandleFunc("/{shortUuid}/v2ray-json", v2rayJson()).Methods(http.MethodGet)
 	r.PathPrefix("/assets/").Handler(http.StripPrefix("/assets/", http.FileServer(http.Dir("/app/templates/subscription/assets"))))
 	r.PathPrefix("/locales/").Handler(http.StripPrefix("/locales/", http.FileServer(http.Dir("/app/templates/subscription/locales"))))
+	r.HandleFunc("/{shortUuid}", userAgentRouter(rules)).Methods(http.MethodGet)
+	r.HandleFunc("/{shortUuid}/{format}", formatRouter()).Methods(http.MethodGet)
 
 	//r.PathPrefix("/assets/").Handler(http.StripPrefix("/assets/", http.FileServer(http.Dir("./templates/subscription/assets"))))
 	//r.PathPrefix("/locales/").Handler(http.StripPrefix("/locales/", http.FileServer(http.Dir("./templates/subscription/locales"))))
@@ -40,11 +48,38 @@ func Start() {
 	}
 }
 
-func v2rayJson() http.HandlerFunc {
+// formatHandlers are the outputs that can be requested explicitly with
+// ?format= or /{shortUuid}/{format}, bypassing User-Agent detection.
+var formatHandlers = map[string]http.HandlerFunc{
+	"raw":        rest.RawLinks,
+	"base64":     rest.Base64Links,
+	"v2ray-json": rest.V2rayJson,
+	"balancer":   rest.BalancerConfig,
+	"happ-json":  rest.HappJson,
+	"web":        rest.WebPage,
+	"sing-box":   rest.SingBox,
+	"mihomo":     rest.Mihomo,
+	"direct":     rest.Direct,
+}
+
+func formatRouter() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		rest.V2rayJson(w, r)
+		serveFormat(w, r, mux.Vars(r)["format"])
+	}
+}
+
+func serveFormat(w http.ResponseWriter, r *http.Request, format string) {
+	handler, ok := formatHandlers[format]
+	if !ok {
+		formats := make([]string, 0, len(formatHandlers))
+		for name := range formatHandlers {
+			formats = append(formats, name)
+		}
+		sort.Strings(formats)
+		http.Error(w, fmt.Sprintf("unknown format %q, valid formats: %s", format, strings.Join(formats, ", ")), http.StatusBadRequest)
 		return
 	}
+	handler(w, r)
 }
 
 func Stop() {
@@ -79,39 +114,80 @@ func httpsAndProxyMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func userAgentRouter() http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		userAgent := r.Header.Get("User-Agent")
-		if isBrowser(userAgent) {
-			rest.WebPage(w, r)
-			return
+// ruleFlags are the feature flags a User-Agent rule can require.
+var ruleFlags = map[string]func() bool{
+	"balancer":  config.IsBalancerEnabled,
+	"happ-json": config.IsHappJsonEnabled,
+}
+
+// validateUserAgentRules fails fast on rules naming unknown handlers or flags.
+func validateUserAgentRules(rules []useragent.Rule) error {
+	for _, rule := range rules {
+		if _, ok := formatHandlers[rule.Handler]; !ok {
+			return fmt.Errorf("user agent rule %s: unknown handler %s", rule.Name, rule.Handler)
 		}
-		if strings.Contains(userAgent, "Streisand") {
-			rest.V2rayJson(w, r)
-			return
+		if _, ok := ruleFlags[rule.Requires]; rule.Requires != "" && !ok {
+			return fmt.Errorf("user agent rule %s: unknown flag %s", rule.Name, rule.Requires)
 		}
+	}
+	return nil
+}
 
-		if strings.Contains(userAgent, "Happ") && config.IsBalancerEnabled() {
-			rest.BalancerConfig(w, r)
+// userAgentRouter serves the handler of the first rule matching the
+// User-Agent, or the panel response when none does.
+func userAgentRouter(rules []useragent.Rule) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if format := r.URL.Query().Get("format"); format != "" {
+			serveFormat(w, r, format)
 			return
 		}
 
-		if strings.Contains(userAgent, "Happ") && config.IsHappJsonEnabled() {
-			rest.HappJson(w, r)
+		userAgent := r.Header.Get("User-Agent")
+		for _, rule := range rules {
+			if rule.Requires != "" && !ruleFlags[rule.Requires]() {
+				continue
+			}
+			if !rule.Matches(userAgent) {
+				continue
+			}
+
+			if len(rule.Headers) > 0 {
+				w = &ruleHeaderWriter{ResponseWriter: w, headers: rule.Headers}
+			}
+			formatHandlers[rule.Handler](w, r)
 			return
 		}
 
-		rest.Direct(w, r)
+		formatHandlers["direct"](w, r)
 	}
 }
 
-var browserKeywords = [...]string{"Mozilla", "Chrome", "Safari", "Firefox", "Opera", "Edge", "TelegramBot"}
+// ruleHeaderWriter sets the headers of a matched rule once the handler starts
+// its response, so they replace panel headers of the same name instead of
+// being sent next to them.
+type ruleHeaderWriter struct {
+	http.ResponseWriter
+	headers map[string]string
+	applied bool
+}
 
-func isBrowser(userAgent string) bool {
-	for _, keyword := range browserKeywords {
-		if strings.Contains(userAgent, keyword) {
-			return true
+func (w *ruleHeaderWriter) WriteHeader(statusCode int) {
+	if !w.applied {
+		w.applied = true
+		for key, value := range w.headers {
+			w.Header().Set(key, value)
 		}
 	}
-	return false
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *ruleHeaderWriter) Write(b []byte) (int, error) {
+	if !w.applied {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *ruleHeaderWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
 }
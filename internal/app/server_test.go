@@ -0,0 +1,161 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"remnawave-json/internal/useragent"
+	"strings"
+	"testing"
+)
+
+// stubHandlers replaces every format handler with one writing its own format
+// name, restoring the real ones when the test ends.
+func stubHandlers(t *testing.T) {
+	t.Helper()
+
+	original := formatHandlers
+	formatHandlers = make(map[string]http.HandlerFunc, len(original))
+	for format := range original {
+		formatHandlers[format] = func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(format))
+		}
+	}
+	t.Cleanup(func() { formatHandlers = original })
+}
+
+func TestServeFormat(t *testing.T) {
+	stubHandlers(t)
+
+	for _, format := range []string{"raw", "v2ray-json", "sing-box", "direct"} {
+		rec := httptest.NewRecorder()
+		serveFormat(rec, httptest.NewRequest(http.MethodGet, "/abc", nil), format)
+		if rec.Code != http.StatusOK || rec.Body.String() != format {
+			t.Errorf("serveFormat(%q) = %d %q, want 200 %q", format, rec.Code, rec.Body.String(), format)
+		}
+	}
+}
+
+func TestServeFormatUnknown(t *testing.T) {
+	stubHandlers(t)
+
+	rec := httptest.NewRecorder()
+	serveFormat(rec, httptest.NewRequest(http.MethodGet, "/abc", nil), "xml")
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400", rec.Code)
+	}
+	want := `unknown format "xml", valid formats: balancer, base64, direct, happ-json, mihomo, raw, sing-box, v2ray-json, web`
+	if got := strings.TrimSpace(rec.Body.String()); got != want {
+		t.Errorf("body = %q, want %q", got, want)
+	}
+}
+
+func TestUserAgentRouterFormatOverride(t *testing.T) {
+	stubHandlers(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/abc?format=mihomo", nil)
+	req.Header.Set("User-Agent", "Mozilla/5.0")
+	rec := httptest.NewRecorder()
+	userAgentRouter(nil)(rec, req)
+	if got := rec.Body.String(); got != "mihomo" {
+		t.Errorf("?format=mihomo served %q", got)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/abc?format=xml", nil)
+	rec = httptest.NewRecorder()
+	userAgentRouter(nil)(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("?format=xml status = %d, want 400", rec.Code)
+	}
+}
+
+func TestUserAgentRouter(t *testing.T) {
+	stubHandlers(t)
+
+	flags := map[string]bool{"balancer": false, "happ-json": true}
+	original := ruleFlags
+	ruleFlags = map[string]func() bool{
+		"balancer":  func() bool { return flags["balancer"] },
+		"happ-json": func() bool { return flags["happ-json"] },
+	}
+	t.Cleanup(func() { ruleFlags = original })
+
+	rules, err := useragent.Compile([]useragent.Rule{
+		{Name: "old-happ", Match: `Happ/([\d.]+)`, Version: "<1.9", Handler: "v2ray-json"},
+		{Name: "happ-balancer", Match: "Happ", Requires: "balancer", Handler: "balancer"},
+		{Name: "happ-json", Match: "Happ", Requires: "happ-json", Handler: "happ-json"},
+		{Name: "happ", Match: "Happ", Handler: "raw"},
+		{Name: "browser", Match: "Mozilla", Handler: "web"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validateUserAgentRules(rules); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		userAgent string
+		balancer  bool
+		want      string
+	}{
+		{"first match wins", "Happ/1.8.0", true, "v2ray-json"},
+		{"required flag on", "Happ/2.0.0", true, "balancer"},
+		{"required flag off", "Happ/2.0.0", false, "happ-json"},
+		{"later rule", "Mozilla/5.0", false, "web"},
+		{"no match", "curl/8.0", false, "direct"},
+	}
+	for _, tt := range tests {
+		flags["balancer"] = tt.balancer
+		req := httptest.NewRequest(http.MethodGet, "/abc", nil)
+		req.Header.Set("User-Agent", tt.userAgent)
+		rec := httptest.NewRecorder()
+		userAgentRouter(rules)(rec, req)
+		if got := rec.Body.String(); got != tt.want {
+			t.Errorf("%s: %s served %q, want %q", tt.name, tt.userAgent, got, tt.want)
+		}
+	}
+}
+
+func TestUserAgentRouterHeaders(t *testing.T) {
+	stubHandlers(t)
+	formatHandlers["raw"] = func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Profile-Title", "panel")
+		w.Header().Add("Support-Url", "https://panel.example")
+		w.Write([]byte("raw"))
+	}
+
+	rules, err := useragent.Compile([]useragent.Rule{
+		{Name: "raw", Match: "Happ", Handler: "raw", Headers: map[string]string{"Profile-Title": "rule"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/abc", nil)
+	req.Header.Set("User-Agent", "Happ/2.0.0")
+	rec := httptest.NewRecorder()
+	userAgentRouter(rules)(rec, req)
+
+	if got := rec.Header().Values("Profile-Title"); len(got) != 1 || got[0] != "rule" {
+		t.Errorf("Profile-Title = %q, want only the rule header", got)
+	}
+	if got := rec.Header().Get("Support-Url"); got != "https://panel.example" {
+		t.Errorf("Support-Url = %q, want the panel header kept", got)
+	}
+}
+
+func TestValidateUserAgentRules(t *testing.T) {
+	tests := []struct {
+		name string
+		rule useragent.Rule
+	}{
+		{"unknown handler", useragent.Rule{Name: "x", Match: "x", Handler: "xml"}},
+		{"unknown flag", useragent.Rule{Name: "x", Match: "x", Handler: "raw", Requires: "mux"}},
+	}
+	for _, tt := range tests {
+		if err := validateUserAgentRules([]useragent.Rule{tt.rule}); err == nil {
+			t.Errorf("%s: validateUserAgentRules() = nil, want an error", tt.name)
+		}
+	}
+}
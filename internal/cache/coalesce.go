@@ -0,0 +1,115 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Coalescer collapses concurrent identical GET requests into one upstream
+// call and hands every waiter its own copy of the response. A body over
+// MaxBodyBytes is streamed to the leader only and the waiters fetch their own.
+// KeyHeaders are request headers that make two requests different, as for
+// Transport.
+type Coalescer struct {
+	Next         http.RoundTripper
+	MaxBodyBytes int64
+	KeyHeaders   []string
+
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+type call struct {
+	done  chan struct{}
+	entry *entry
+	err   error
+}
+
+func (c *Coalescer) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet {
+		return c.Next.RoundTrip(req)
+	}
+
+	key := cacheKey(req, c.KeyHeaders)
+
+	c.mu.Lock()
+	if c.calls == nil {
+		c.calls = make(map[string]*call)
+	}
+	if inFlight, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		return c.wait(inFlight, req)
+	}
+	leader := &call{done: make(chan struct{})}
+	c.calls[key] = leader
+	c.mu.Unlock()
+
+	var streamed *http.Response
+	leader.entry, streamed, leader.err = c.do(req)
+	if streamed != nil {
+		leader.err = errNotShared
+	}
+
+	c.mu.Lock()
+	delete(c.calls, key)
+	c.mu.Unlock()
+	close(leader.done)
+
+	if streamed != nil {
+		return streamed, nil
+	}
+	if leader.err != nil {
+		return nil, leader.err
+	}
+	return leader.entry.response(req), nil
+}
+
+// errNotShared tells waiters the leader's response could not be shared.
+var errNotShared = errors.New("response too large to share")
+
+func (c *Coalescer) wait(inFlight *call, req *http.Request) (*http.Response, error) {
+	select {
+	case <-inFlight.done:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+
+	// The leader's client went away, ran out of time or got a body that can't
+	// be shared; that says nothing about this request.
+	if errors.Is(inFlight.err, context.Canceled) || errors.Is(inFlight.err, context.DeadlineExceeded) ||
+		errors.Is(inFlight.err, errNotShared) {
+		return c.RoundTrip(req)
+	}
+	if inFlight.err != nil {
+		return nil, inFlight.err
+	}
+	return inFlight.entry.response(req), nil
+}
+
+// do performs the call, returning either a shareable entry or, for a body
+// over MaxBodyBytes, the response to stream.
+func (c *Coalescer) do(req *http.Request) (*entry, *http.Response, error) {
+	resp, err := c.Next.RoundTrip(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	body, rest, err := readBody(resp.Body, c.MaxBodyBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	if rest != nil {
+		resp.Body = rest
+		return nil, resp, nil
+	}
+
+	return &entry{
+		status:   resp.StatusCode,
+		header:   resp.Header.Clone(),
+		body:     body,
+		storedAt: time.Now(),
+	}, nil, nil
+}
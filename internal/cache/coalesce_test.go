@@ -0,0 +1,158 @@
+package cache
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// gatedTransport counts calls and holds each one until release is closed or
+// the request context ends.
+type gatedTransport struct {
+	calls   atomic.Int32
+	release chan struct{}
+}
+
+func (g *gatedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	g.calls.Add(1)
+	select {
+	case <-g.release:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader("config for " + req.Header.Get("X-Hwid"))),
+		Request:    req,
+	}, nil
+}
+
+type result struct {
+	body string
+	err  error
+}
+
+func fetchAsync(ctx context.Context, rt http.RoundTripper, hwid string) <-chan result {
+	done := make(chan result, 1)
+	go func() {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://panel/api/sub/abc", nil)
+		req.Header.Set("X-Hwid", hwid)
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		done <- result{body: string(body), err: err}
+	}()
+	return done
+}
+
+func waitCalls(t *testing.T, g *gatedTransport, n int32) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for g.calls.Load() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("upstream calls = %d, want %d", g.calls.Load(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCoalescer(t *testing.T) {
+	tests := []struct {
+		name      string
+		hwids     []string
+		wantCalls int32
+	}{
+		{"identical requests share one call", []string{"dev1", "dev1", "dev1", "dev1", "dev1"}, 1},
+		{"key headers are not merged", []string{"dev1", "dev2", "dev1", "dev2"}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gate := &gatedTransport{release: make(chan struct{})}
+			c := &Coalescer{Next: gate, KeyHeaders: []string{"X-Hwid"}}
+
+			var results []<-chan result
+			for _, hwid := range tt.hwids {
+				results = append(results, fetchAsync(context.Background(), c, hwid))
+			}
+			waitCalls(t, gate, tt.wantCalls)
+			// Give the remaining callers time to join the calls in flight.
+			time.Sleep(20 * time.Millisecond)
+			close(gate.release)
+
+			for i, done := range results {
+				res := <-done
+				if want := "config for " + tt.hwids[i]; res.err != nil || res.body != want {
+					t.Errorf("caller %d got (%q, %v), want %q", i, res.body, res.err, want)
+				}
+			}
+			if calls := gate.calls.Load(); calls != tt.wantCalls {
+				t.Errorf("upstream calls = %d, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestCoalescerLeaderFailureDoesNotFailWaiters(t *testing.T) {
+	tests := []struct {
+		name   string
+		leader func() (context.Context, context.CancelFunc)
+		end    func(cancel context.CancelFunc)
+	}{
+		{
+			name:   "canceled",
+			leader: func() (context.Context, context.CancelFunc) { return context.WithCancel(context.Background()) },
+			end:    func(cancel context.CancelFunc) { cancel() },
+		},
+		{
+			name: "deadline exceeded",
+			leader: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), 50*time.Millisecond)
+			},
+			end: func(context.CancelFunc) {},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gate := &gatedTransport{release: make(chan struct{})}
+			c := &Coalescer{Next: gate, KeyHeaders: []string{"X-Hwid"}}
+
+			ctx, cancel := tt.leader()
+			defer cancel()
+			leader := fetchAsync(ctx, c, "dev1")
+			waitCalls(t, gate, 1)
+
+			var waiters []<-chan result
+			for range 3 {
+				waiters = append(waiters, fetchAsync(context.Background(), c, "dev1"))
+			}
+			time.Sleep(20 * time.Millisecond)
+			tt.end(cancel)
+
+			if res := <-leader; res.err == nil {
+				t.Fatal("leader succeeded, want its context error")
+			}
+			// The waiters retry together in a call of their own.
+			waitCalls(t, gate, 2)
+			time.Sleep(20 * time.Millisecond)
+			close(gate.release)
+
+			for i, done := range waiters {
+				if res := <-done; res.err != nil || res.body != "config for dev1" {
+					t.Errorf("waiter %d got (%q, %v)", i, res.body, res.err)
+				}
+			}
+			if calls := gate.calls.Load(); calls != 2 {
+				t.Errorf("upstream calls = %d, want 2", calls)
+			}
+		})
+	}
+}
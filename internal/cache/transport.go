@@ -0,0 +1,280 @@
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"remnawave-json/internal/useragent"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transport caches successful GET responses from the panel. Entries younger
+// than TTL are served as is; until TTL+StaleTTL they are served while being
+// refreshed in the background; up to StaleIfError they are only served when
+// the panel can't answer. A 404 or 410 from the panel evicts the entry.
+// RefreshTimeout bounds background refreshes. MaxEntries and MaxBytes bound
+// the number of entries and their total size, the least recently used being
+// dropped first. Bodies over MaxBodyBytes are streamed through without being
+// cached. KeyHeaders are request headers the panel's answer depends on.
+type Transport struct {
+	Next           http.RoundTripper
+	TTL            time.Duration
+	StaleTTL       time.Duration
+	StaleIfError   time.Duration
+	RefreshTimeout time.Duration
+	MaxEntries     int
+	MaxBytes       int64
+	MaxBodyBytes   int64
+	KeyHeaders     []string
+
+	mu        sync.Mutex
+	entries   map[string]*list.Element
+	lru       *list.List // of *entry, most recently used first
+	size      int64
+	lastSweep time.Time
+}
+
+type entry struct {
+	key        string
+	status     int
+	header     http.Header
+	body       []byte
+	storedAt   time.Time
+	refreshing bool
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet || t.TTL <= 0 {
+		return t.Next.RoundTrip(req)
+	}
+
+	key := cacheKey(req, t.KeyHeaders)
+	now := time.Now()
+
+	t.mu.Lock()
+	cached, ok := t.lookup(key)
+	if ok {
+		age := now.Sub(cached.storedAt)
+		if age < t.TTL {
+			t.mu.Unlock()
+			return cached.response(req), nil
+		}
+		if age < t.TTL+t.StaleTTL {
+			if !cached.refreshing {
+				cached.refreshing = true
+				go t.refresh(key, req)
+			}
+			t.mu.Unlock()
+			return cached.response(req), nil
+		}
+	}
+	t.mu.Unlock()
+
+	resp, err := t.fetch(key, req)
+	if err == nil && resp.StatusCode < http.StatusInternalServerError {
+		return resp, nil
+	}
+
+	if ok && now.Sub(cached.storedAt) < t.StaleIfError {
+		slog.Warn("Serving stale panel response", "url", req.URL.Path, "error", err)
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return cached.response(req), nil
+	}
+	return resp, err
+}
+
+// lookup returns the entry for key and marks it as recently used. t.mu must
+// be held.
+func (t *Transport) lookup(key string) (*entry, bool) {
+	el, ok := t.entries[key]
+	if !ok {
+		return nil, false
+	}
+	t.lru.MoveToFront(el)
+	return el.Value.(*entry), true
+}
+
+// fetch performs the request, stores a successful response and forgets the
+// entry of a user the panel no longer knows.
+func (t *Transport) fetch(key string, req *http.Request) (*http.Response, error) {
+	resp, err := t.Next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		t.evict(key)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return resp, nil
+	}
+
+	body, rest, err := readBody(resp.Body, t.MaxBodyBytes)
+	if err != nil {
+		return nil, err
+	}
+	if rest != nil {
+		resp.Body = rest
+		return resp, nil
+	}
+
+	stored := &entry{
+		key:      key,
+		status:   resp.StatusCode,
+		header:   resp.Header.Clone(),
+		body:     body,
+		storedAt: time.Now(),
+	}
+	t.store(stored)
+	return stored.response(req), nil
+}
+
+func (t *Transport) refresh(key string, req *http.Request) {
+	ctx := context.Background()
+	if t.RefreshTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.RefreshTimeout)
+		defer cancel()
+	}
+
+	resp, err := t.fetch(key, req.Clone(ctx))
+	if err != nil {
+		slog.Warn("Background refresh of panel response failed", "url", req.URL.Path, "error", err)
+	} else {
+		resp.Body.Close()
+	}
+
+	// A successful refresh replaced the entry; anything else leaves the old
+	// one, which must be refreshable again.
+	t.mu.Lock()
+	if el, ok := t.entries[key]; ok {
+		el.Value.(*entry).refreshing = false
+	}
+	t.mu.Unlock()
+}
+
+func (t *Transport) evict(key string) {
+	t.mu.Lock()
+	if el, ok := t.entries[key]; ok {
+		t.remove(el)
+	}
+	t.mu.Unlock()
+}
+
+func (t *Transport) store(stored *entry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.entries == nil {
+		t.entries = make(map[string]*list.Element)
+		t.lru = list.New()
+	}
+	if el, ok := t.entries[stored.key]; ok {
+		t.remove(el)
+	}
+	t.entries[stored.key] = t.lru.PushFront(stored)
+	t.size += stored.size()
+
+	for t.lru.Len() > 0 && (t.MaxEntries > 0 && t.lru.Len() > t.MaxEntries || t.MaxBytes > 0 && t.size > t.MaxBytes) {
+		t.remove(t.lru.Back())
+	}
+
+	if stored.storedAt.Sub(t.lastSweep) < t.TTL {
+		return
+	}
+	t.lastSweep = stored.storedAt
+	for el := t.lru.Front(); el != nil; {
+		next := el.Next()
+		age := stored.storedAt.Sub(el.Value.(*entry).storedAt)
+		if age > t.TTL+t.StaleTTL && age > t.StaleIfError {
+			t.remove(el)
+		}
+		el = next
+	}
+}
+
+// remove drops an entry. t.mu must be held.
+func (t *Transport) remove(el *list.Element) {
+	e := t.lru.Remove(el).(*entry)
+	delete(t.entries, e.key)
+	t.size -= e.size()
+}
+
+// readBody reads body whole when it fits in limit bytes, 0 meaning no limit,
+// and closes it. A larger body is left open and returned as rest, replaying
+// what was already read, for the caller to stream.
+func readBody(body io.ReadCloser, limit int64) (data []byte, rest io.ReadCloser, err error) {
+	if limit <= 0 {
+		defer body.Close()
+		data, err = io.ReadAll(body)
+		return data, nil, err
+	}
+
+	data, err = io.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		body.Close()
+		return nil, nil, err
+	}
+	if int64(len(data)) <= limit {
+		body.Close()
+		return data, nil, nil
+	}
+	return nil, struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(data), body), body}, nil
+}
+
+// size approximates the memory an entry holds.
+func (e *entry) size() int64 {
+	size := len(e.key) + len(e.body)
+	for name, values := range e.header {
+		size += len(name)
+		for _, value := range values {
+			size += len(value)
+		}
+	}
+	return int64(size)
+}
+
+func (e *entry) response(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.status, http.StatusText(e.status)),
+		StatusCode:    e.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        e.header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(e.body)),
+		ContentLength: int64(len(e.body)),
+		Request:       req,
+	}
+}
+
+// cacheKey separates entries by URL and client class, the client name and
+// the features it supports, so every version of a client with the same
+// capabilities shares one entry. keyHeaders split entries further, e.g.
+// x-hwid when the panel limits devices per user.
+func cacheKey(req *http.Request, keyHeaders []string) string {
+	client := useragent.Parse(req.Header.Get("User-Agent"))
+
+	var key strings.Builder
+	key.WriteString(req.URL.String())
+	key.WriteString("|")
+	key.WriteString(strings.ToLower(client.Name))
+	for _, feature := range client.Features() {
+		key.WriteString("+")
+		key.WriteString(string(feature))
+	}
+	for _, name := range keyHeaders {
+		fmt.Fprintf(&key, "|%s=%s", strings.ToLower(name), strings.Join(req.Header.Values(name), ","))
+	}
+	return key.String()
+}
@@ -0,0 +1,169 @@
+package cache
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubTransport answers with status and a body built from the request, and
+// counts the calls it gets.
+type stubTransport struct {
+	calls  atomic.Int32
+	status atomic.Int32
+}
+
+func (s *stubTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	s.calls.Add(1)
+	status := int(s.status.Load())
+	if status == 0 {
+		status = http.StatusOK
+	}
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader(req.Header.Get("X-Hwid") + "|" + req.Header.Get("User-Agent"))),
+		Request:    req,
+	}, nil
+}
+
+func get(t *testing.T, rt http.RoundTripper, header http.Header) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, "http://panel/api/sub/abc", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header = header
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestTransportKeysByClientClass(t *testing.T) {
+	stub := &stubTransport{}
+	cache := &Transport{Next: stub, TTL: time.Minute}
+
+	tests := []struct {
+		header http.Header
+		want   string
+	}{
+		{http.Header{"User-Agent": {"Happ/1.9.2/ios"}}, "|Happ/1.9.2/ios"},
+		// Same name and features: served from the first entry.
+		{http.Header{"User-Agent": {"Happ/1.10.0/android"}, "X-Hwid": {"dev2"}}, "|Happ/1.9.2/ios"},
+		// No balancer support: a class of its own.
+		{http.Header{"User-Agent": {"Happ/1.8.4/ios"}}, "|Happ/1.8.4/ios"},
+		{http.Header{"User-Agent": {"Streisand/250 CFNetwork/1494.0.7 Darwin/23.4.0"}}, "|Streisand/250 CFNetwork/1494.0.7 Darwin/23.4.0"},
+		{http.Header{"User-Agent": {"Streisand/251 CFNetwork/1494.0.7 Darwin/23.4.0"}}, "|Streisand/250 CFNetwork/1494.0.7 Darwin/23.4.0"},
+	}
+	for _, tt := range tests {
+		if _, got := get(t, cache, tt.header); got != tt.want {
+			t.Errorf("body for %v = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+	if calls := stub.calls.Load(); calls != 3 {
+		t.Errorf("upstream calls = %d, want 3", calls)
+	}
+}
+
+func TestTransportKeyHeaders(t *testing.T) {
+	stub := &stubTransport{}
+	cache := &Transport{Next: stub, TTL: time.Minute, KeyHeaders: []string{"x-hwid"}}
+
+	for _, hwid := range []string{"dev1", "dev2", "dev1"} {
+		header := http.Header{"X-Hwid": {hwid}, "User-Agent": {"Happ/1.9.2"}}
+		if _, got := get(t, cache, header); got != hwid+"|Happ/1.9.2" {
+			t.Errorf("body for %s = %q", hwid, got)
+		}
+	}
+	if calls := stub.calls.Load(); calls != 2 {
+		t.Errorf("upstream calls = %d, want 2", calls)
+	}
+}
+
+func TestTransportRefreshEvictsGoneUser(t *testing.T) {
+	stub := &stubTransport{}
+	cache := &Transport{Next: stub, TTL: time.Millisecond, StaleTTL: time.Hour, StaleIfError: time.Hour}
+	header := http.Header{"User-Agent": {"Happ/1.9.2"}}
+
+	get(t, cache, header)
+	stub.status.Store(http.StatusNotFound)
+	time.Sleep(2 * time.Millisecond)
+
+	// Served stale while the background refresh learns the user is gone.
+	if status, _ := get(t, cache, header); status != http.StatusOK {
+		t.Fatalf("stale status = %d, want 200", status)
+	}
+	deadline := time.Now().Add(time.Second)
+	for cached(cache) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if status, _ := get(t, cache, header); status != http.StatusNotFound {
+		t.Errorf("status after refresh = %d, want 404", status)
+	}
+}
+
+func cached(t *Transport) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.entries)
+}
+
+func TestTransportEvictsLeastRecentlyUsed(t *testing.T) {
+	// Every entry holds its key and a two-byte body, so three of them fit in
+	// either limit.
+	key := int64(len(cacheKey(&http.Request{URL: &url.URL{Scheme: "http", Host: "panel", Path: "/api/sub/abc"}, Header: http.Header{"X-Hwid": {"a"}}}, []string{"X-Hwid"})))
+	limits := map[string]*Transport{
+		"entries": {MaxEntries: 3},
+		"bytes":   {MaxBytes: 3*(key+int64(len("a|"))) + 1},
+	}
+	for name, cache := range limits {
+		t.Run(name, func(t *testing.T) {
+			stub := &stubTransport{}
+			cache.Next, cache.TTL, cache.KeyHeaders = stub, time.Minute, []string{"X-Hwid"}
+
+			for _, hwid := range []string{"a", "b", "c", "a", "d"} {
+				get(t, cache, http.Header{"X-Hwid": {hwid}})
+			}
+			if n := cached(cache); n != 3 {
+				t.Fatalf("entries = %d, want 3", n)
+			}
+			if calls := stub.calls.Load(); calls != 4 {
+				t.Fatalf("upstream calls = %d, want 4", calls)
+			}
+
+			// "a" was used after "b", so "b" was the one dropped.
+			get(t, cache, http.Header{"X-Hwid": {"a"}})
+			get(t, cache, http.Header{"X-Hwid": {"b"}})
+			if calls := stub.calls.Load(); calls != 5 {
+				t.Errorf("upstream calls = %d, want 5, only b refetched", calls)
+			}
+		})
+	}
+}
+
+func TestTransportStreamsLargeBodies(t *testing.T) {
+	stub := &stubTransport{}
+	cache := &Transport{Next: stub, TTL: time.Minute, MaxBodyBytes: 4}
+	header := http.Header{"User-Agent": {"Streisand/250"}}
+
+	for range 2 {
+		if _, body := get(t, cache, header); body != "|Streisand/250" {
+			t.Fatalf("body = %q, want it whole", body)
+		}
+	}
+	if calls := stub.calls.Load(); calls != 2 {
+		t.Errorf("upstream calls = %d, want 2, large bodies must not be cached", calls)
+	}
+}
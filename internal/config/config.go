@@ -5,17 +5,28 @@ import (
 	"compress/gzip"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"html/template"
 	"io"
 	"log"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"remnawave-json/internal/cache"
+	"remnawave-json/internal/happ"
+	"remnawave-json/internal/patch"
+	"remnawave-json/internal/resilience"
+	"remnawave-json/internal/useragent"
+	"remnawave-json/internal/userselect"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/andybalholm/brotli"
 	"github.com/joho/godotenv"
 	"github.com/klauspost/compress/zstd"
+	"gopkg.in/yaml.v3"
 )
 
 type config struct {
@@ -26,10 +37,69 @@ type config struct {
 	happJsonEnabled            bool
 	balancerEnabled            bool
 	xApiKey                    string
-	happRouting                string
+	happRouting                happ.Routes
+	balancerHappRouting        string
 	httpClient                 *http.Client
 	ruOutboundName, ruHostName string
+	ruHostMatch                string
 	exceptRuRulesUsers         map[string]string
+	balancerStrategy           string
+	balancerProbeURL           string
+	balancerProbeInterval      string
+	balancerCosts              []BalancerCost
+	xrayTemplate               []byte
+	ruleSets                   []RuleSet
+	singBoxTemplate            []byte
+	mihomoTemplate             []byte
+	userAgentRules             []useragent.Rule
+	requestHeaderDenylist      []string
+	responseHeaderDenylist     []string
+	maxRewriteBody             int64
+	v2rayPatches               []patch.Patch
+}
+
+// BalancerCost weights outbounds whose tag matches the Match regexp when the
+// leastLoad strategy is used.
+type BalancerCost struct {
+	Match string
+	Value float64
+}
+
+// RuleSet is a named group of Xray routing rules injected into the balancer
+// config. Squads and Tags limit the set to the users they select, as any
+// userselect.Selector does; a user in ExcludeSquads or ExcludeTags never gets
+// it.
+type RuleSet struct {
+	Name          string        `json:"name"`
+	Enabled       bool          `json:"enabled"`
+	Squads        []string      `json:"squads"`
+	Tags          []string      `json:"tags"`
+	ExcludeSquads []string      `json:"excludeSquads"`
+	ExcludeTags   []string      `json:"excludeTags"`
+	Rules         []interface{} `json:"rules"`
+}
+
+func (rs RuleSet) AppliesTo(user userselect.User) bool {
+	if !rs.Enabled {
+		return false
+	}
+	if userselect.ContainsAny(rs.ExcludeTags, user.Tag) || userselect.ContainsAny(rs.ExcludeSquads, user.Squads...) {
+		return false
+	}
+	return userselect.Selector{Tags: rs.Tags, Squads: rs.Squads}.Matches(user)
+}
+
+var balancerStrategies = map[string]bool{
+	"random":     true,
+	"roundRobin": true,
+	"leastPing":  true,
+	"leastLoad":  true,
+}
+
+var ruHostMatches = map[string]bool{
+	"remark":     true,
+	"tag":        true,
+	"inboundTag": true,
 }
 
 func GetExceptRuRulesUsers() map[string]string {
@@ -43,10 +113,72 @@ func IsBalancerEnabled() bool {
 	return conf.balancerEnabled
 }
 
-func GetHappRouting() string {
+func GetBalancerStrategy() string {
+	return conf.balancerStrategy
+}
+
+func GetBalancerProbeURL() string {
+	return conf.balancerProbeURL
+}
+
+func GetBalancerProbeInterval() string {
+	return conf.balancerProbeInterval
+}
+
+func GetBalancerCosts() []BalancerCost {
+	return conf.balancerCosts
+}
+
+func GetXrayTemplate() []byte {
+	return conf.xrayTemplate
+}
+
+func GetSingBoxTemplate() []byte {
+	return conf.singBoxTemplate
+}
+
+func GetMihomoTemplate() []byte {
+	return conf.mihomoTemplate
+}
+
+func GetUserAgentRules() []useragent.Rule {
+	return conf.userAgentRules
+}
+
+func GetRequestHeaderDenylist() []string {
+	return conf.requestHeaderDenylist
+}
+
+func GetResponseHeaderDenylist() []string {
+	return conf.responseHeaderDenylist
+}
+
+// GetMaxRewriteBody is the largest panel response that is buffered in memory
+// to be rewritten; larger ones are rejected.
+func GetMaxRewriteBody() int64 {
+	return conf.maxRewriteBody
+}
+
+func GetV2rayPatches() []patch.Patch {
+	return conf.v2rayPatches
+}
+
+func GetRuleSets() []RuleSet {
+	return conf.ruleSets
+}
+
+// GetHappRouting holds the routing header values for Happ: HAPP_ROUTING as is,
+// or the profiles from the routing file.
+func GetHappRouting() happ.Routes {
 	return conf.happRouting
 }
 
+// GetBalancerHappRouting is the built-in Happ routing link the balancer config
+// falls back to when no profile is configured for the user.
+func GetBalancerHappRouting() string {
+	return conf.balancerHappRouting
+}
+
 func GetAppPort() string {
 	return conf.appPort
 }
@@ -75,6 +207,12 @@ func GetRuHostName() string {
 	return conf.ruHostName
 }
 
+// GetRuHostMatch tells which host field RU_USER_HOST is compared with:
+// remark, tag or inboundTag.
+func GetRuHostMatch() string {
+	return conf.ruHostMatch
+}
+
 func GetXApiKey() string {
 	return conf.xApiKey
 }
@@ -143,10 +281,48 @@ func InitConfig() {
 
 	conf.xApiKey = os.Getenv("X_API_KEY")
 
+	panelTransport := http.DefaultTransport.(*http.Transport).Clone()
+	panelTransport.DialContext = (&net.Dialer{
+		Timeout:   getDuration("PANEL_CONNECT_TIMEOUT", 5*time.Second),
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	panelTransport.TLSHandshakeTimeout = getDuration("PANEL_CONNECT_TIMEOUT", 5*time.Second)
+	panelTransport.ResponseHeaderTimeout = getDuration("PANEL_HEADER_TIMEOUT", 10*time.Second)
+	// Panel responses up to this size are read in full by the cache and the
+	// coalescer, even when a handler only passes them through; larger ones
+	// are streamed and never shared.
+	maxCachedBody := int64(getInt("CACHE_MAX_BODY_BYTES", 2<<20))
+	cacheKeyHeaders := splitList(os.Getenv("CACHE_KEY_HEADERS"))
+
 	conf.httpClient = &http.Client{
-		Transport: &decompressingRoundTripper{
-			rt:      http.DefaultTransport,
-			xApiKey: GetXApiKey(),
+		Timeout: getDuration("PANEL_TIMEOUT", 30*time.Second),
+		Transport: &cache.Transport{
+			Next: &cache.Coalescer{
+				MaxBodyBytes: maxCachedBody,
+				KeyHeaders:   cacheKeyHeaders,
+				Next: &resilience.Transport{
+					Next: &decompressingRoundTripper{
+						rt:      panelTransport,
+						xApiKey: GetXApiKey(),
+					},
+					MaxRetries: getInt("PANEL_RETRIES", 2),
+					BaseDelay:  getDuration("PANEL_RETRY_BASE_DELAY", 200*time.Millisecond),
+					MaxDelay:   getDuration("PANEL_RETRY_MAX_DELAY", 2*time.Second),
+					Breaker: &resilience.Breaker{
+						Threshold: getInt("PANEL_BREAKER_THRESHOLD", 5),
+						Cooldown:  getDuration("PANEL_BREAKER_COOLDOWN", 30*time.Second),
+					},
+				},
+			},
+			TTL:          getDuration("CACHE_TTL", time.Minute),
+			StaleTTL:     getDuration("CACHE_STALE_TTL", 10*time.Minute),
+			StaleIfError: getDuration("CACHE_STALE_IF_ERROR", 24*time.Hour),
+			// Background refreshes are not covered by the client timeout.
+			RefreshTimeout: getDuration("PANEL_TIMEOUT", 30*time.Second),
+			MaxEntries:     getInt("CACHE_MAX_ENTRIES", 10000),
+			MaxBytes:       int64(getInt("CACHE_MAX_BYTES", 64<<20)),
+			MaxBodyBytes:   maxCachedBody,
+			KeyHeaders:     cacheKeyHeaders,
 		},
 	}
 
@@ -163,10 +339,102 @@ func InitConfig() {
 
 	conf.balancerEnabled = os.Getenv("IS_BALANCER_ENABLED") == "true"
 
-	conf.happRouting = os.Getenv("HAPP_ROUTING")
+	conf.balancerStrategy = os.Getenv("BALANCER_STRATEGY")
+	if conf.balancerStrategy == "" {
+		conf.balancerStrategy = "roundRobin"
+	}
+	if !balancerStrategies[conf.balancerStrategy] {
+		slog.Error("unknown balancer strategy: " + conf.balancerStrategy)
+		panic(errors.New("unknown balancer strategy"))
+	}
+
+	conf.balancerProbeURL = os.Getenv("BALANCER_PROBE_URL")
+	if conf.balancerProbeURL == "" {
+		conf.balancerProbeURL = "https://connectivitycheck.gstatic.com/generate_204"
+	}
+	conf.balancerProbeInterval = os.Getenv("BALANCER_PROBE_INTERVAL")
+	if conf.balancerProbeInterval == "" {
+		conf.balancerProbeInterval = "5m"
+	}
+
+	conf.balancerCosts, err = parseBalancerCosts(os.Getenv("BALANCER_COSTS"))
+	if err != nil {
+		slog.Error("parsing BALANCER_COSTS:")
+		panic(err)
+	}
+
+	conf.xrayTemplate, err = loadXrayTemplate()
+	if err != nil {
+		if conf.balancerEnabled {
+			slog.Error("loading xray template:")
+			panic(err)
+		}
+		slog.Warn("Xray template not loaded, balancer config is unavailable", "error", err)
+	}
+
+	conf.singBoxTemplate, err = loadJSONTemplate("SING_BOX_TEMPLATE_PATH", "/app/templates/sing-box/default.json")
+	if err != nil {
+		slog.Warn("Sing-box template not loaded, sing-box config is unavailable", "error", err)
+	}
+
+	conf.mihomoTemplate, err = loadMihomoTemplate()
+	if err != nil {
+		slog.Warn("Mihomo template not loaded, mihomo config is unavailable", "error", err)
+	}
+
+	conf.userAgentRules, err = loadUserAgentRules()
+	if err != nil {
+		slog.Error("loading user agent rules:")
+		panic(err)
+	}
+
+	conf.v2rayPatches, err = loadV2rayPatches()
+	if err != nil {
+		slog.Error("loading v2ray patches:")
+		panic(err)
+	}
+
+	conf.ruleSets, err = loadRuleSets()
+	if err != nil {
+		if conf.balancerEnabled {
+			slog.Error("loading rule sets:")
+			panic(err)
+		}
+		slog.Warn("Rule sets not loaded", "error", err)
+	}
+
+	conf.happRouting = happ.Static(os.Getenv("HAPP_ROUTING"))
+	if conf.happRouting.Default == "" {
+		conf.happRouting, err = loadHappRouting()
+		if err != nil {
+			slog.Error("loading happ routing:")
+			panic(err)
+		}
+	}
+	conf.balancerHappRouting, err = happ.BalancerProfile.Encode("onadd")
+	if err != nil {
+		slog.Error("encoding balancer happ routing:")
+		panic(err)
+	}
 
 	conf.ruHostName = os.Getenv("RU_USER_HOST")
+	conf.ruHostMatch = os.Getenv("RU_USER_HOST_MATCH")
+	if conf.ruHostMatch == "" {
+		conf.ruHostMatch = "remark"
+	}
+	if !ruHostMatches[conf.ruHostMatch] {
+		slog.Error("unknown RU host match: " + conf.ruHostMatch)
+		panic(errors.New("unknown RU host match"))
+	}
 	conf.ruOutboundName = os.Getenv("RU_OUTBOUND_NAME")
+	if conf.ruOutboundName == "" {
+		conf.ruOutboundName = "RU"
+	}
+
+	conf.requestHeaderDenylist = splitList(os.Getenv("REQUEST_HEADERS_DENYLIST"))
+	conf.responseHeaderDenylist = splitList(os.Getenv("RESPONSE_HEADERS_DENYLIST"))
+
+	conf.maxRewriteBody = int64(getInt("MAX_REWRITE_BODY_BYTES", 8<<20))
 
 	conf.exceptRuRulesUsers = make(map[string]string)
 	envVal := os.Getenv("EXCEPT_RU_RULES_USERS")
@@ -201,6 +469,189 @@ func InitConfig() {
 
 }
 
+// loadXrayTemplate reads the base config the balancer outbounds are injected
+// into, picking the mux variant when V2RAY_MUX_ENABLED is set.
+func loadXrayTemplate() ([]byte, error) {
+	if os.Getenv("V2RAY_MUX_ENABLED") == "true" {
+		return loadJSONTemplate("V2RAY_MUX_TEMPLATE_PATH", "/app/templates/v2ray/mux_default.json")
+	}
+	return loadJSONTemplate("V2RAY_TEMPLATE_PATH", "/app/templates/v2ray/default.json")
+}
+
+// loadJSONTemplate reads a JSON template from the path in envName, falling
+// back to defaultPath.
+func loadJSONTemplate(envName, defaultPath string) ([]byte, error) {
+	templatePath := os.Getenv(envName)
+	if templatePath == "" {
+		templatePath = defaultPath
+	}
+
+	data, err := os.ReadFile(templatePath)
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(data) {
+		return nil, fmt.Errorf("%s is not valid JSON", templatePath)
+	}
+	return data, nil
+}
+
+func loadMihomoTemplate() ([]byte, error) {
+	templatePath := os.Getenv("MIHOMO_TEMPLATE_PATH")
+	if templatePath == "" {
+		templatePath = "/app/templates/mihomo/default.yaml"
+	}
+
+	data, err := os.ReadFile(templatePath)
+	if err != nil {
+		return nil, err
+	}
+	var probe map[string]interface{}
+	if err := yaml.Unmarshal(data, &probe); err != nil {
+		return nil, fmt.Errorf("%s is not valid YAML: %w", templatePath, err)
+	}
+	return data, nil
+}
+
+// loadHappRouting encodes the Happ routing profiles from HAPP_ROUTING_PATH.
+// The file is opt-in: without it Happ JSON gets no routing header.
+func loadHappRouting() (happ.Routes, error) {
+	routingPath := os.Getenv("HAPP_ROUTING_PATH")
+	if routingPath == "" {
+		return happ.Routes{}, nil
+	}
+	return happ.LoadRouting(routingPath)
+}
+
+// loadUserAgentRules reads the User-Agent routing table and capability matrix,
+// falling back to the built-in rules when the file is absent.
+func loadUserAgentRules() ([]useragent.Rule, error) {
+	rulesPath := os.Getenv("USER_AGENT_RULES_PATH")
+	if rulesPath == "" {
+		rulesPath = "/app/templates/user_agents.json"
+	}
+
+	rules, capabilities, err := useragent.LoadRules(rulesPath)
+	if errors.Is(err, os.ErrNotExist) {
+		slog.Warn("User agent rules not found, using built-in rules", "path", rulesPath)
+		return useragent.Compile(useragent.DefaultRules)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if capabilities != nil {
+		if err := useragent.SetCapabilities(capabilities); err != nil {
+			return nil, fmt.Errorf("%s: %w", rulesPath, err)
+		}
+	}
+	return rules, nil
+}
+
+// loadV2rayPatches reads the per-user v2ray-json patches; no file means no
+// patches.
+func loadV2rayPatches() ([]patch.Patch, error) {
+	patchesPath := os.Getenv("V2RAY_PATCHES_PATH")
+	if patchesPath == "" {
+		patchesPath = "/app/templates/v2ray/patches.json"
+	}
+
+	patches, err := patch.Load(patchesPath)
+	if errors.Is(err, os.ErrNotExist) {
+		slog.Info("V2ray patches not found", "path", patchesPath)
+		return nil, nil
+	}
+	return patches, err
+}
+
+// loadRuleSets reads the ordered list of routing rule sets, disabling the
+// ones named in RULE_SETS_DISABLED.
+func loadRuleSets() ([]RuleSet, error) {
+	ruleSetsPath := os.Getenv("RULE_SETS_PATH")
+	if ruleSetsPath == "" {
+		ruleSetsPath = "/app/templates/v2ray/rule_sets.json"
+	}
+
+	data, err := os.ReadFile(ruleSetsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var ruleSets []RuleSet
+	if err := json.Unmarshal(data, &ruleSets); err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", ruleSetsPath, err)
+	}
+
+	for _, name := range strings.Split(os.Getenv("RULE_SETS_DISABLED"), ",") {
+		name = strings.TrimSpace(name)
+		for i := range ruleSets {
+			if ruleSets[i].Name == name {
+				ruleSets[i].Enabled = false
+			}
+		}
+	}
+	return ruleSets, nil
+}
+
+func splitList(envVal string) []string {
+	var values []string
+	for _, v := range strings.Split(envVal, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+func getInt(envName string, defaultValue int) int {
+	envVal := os.Getenv(envName)
+	if envVal == "" {
+		return defaultValue
+	}
+
+	value, err := strconv.Atoi(envVal)
+	if err != nil {
+		slog.Error("parsing " + envName + ":")
+		panic(err)
+	}
+	return value
+}
+
+func getDuration(envName string, defaultValue time.Duration) time.Duration {
+	envVal := os.Getenv(envName)
+	if envVal == "" {
+		return defaultValue
+	}
+
+	value, err := time.ParseDuration(envVal)
+	if err != nil {
+		slog.Error("parsing " + envName + ":")
+		panic(err)
+	}
+	return value
+}
+
+// parseBalancerCosts reads a comma separated list of tagRegexp:cost pairs.
+func parseBalancerCosts(envVal string) ([]BalancerCost, error) {
+	var costs []BalancerCost
+	for _, v := range strings.Split(envVal, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		idx := strings.LastIndex(v, ":")
+		if idx <= 0 {
+			return nil, fmt.Errorf("invalid cost %q, expected tag:value", v)
+		}
+		value, err := strconv.ParseFloat(v[idx+1:], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cost %q: %w", v, err)
+		}
+		costs = append(costs, BalancerCost{Match: v[:idx], Value: value})
+	}
+	return costs, nil
+}
+
 func ConvertJsonStringIntoMap(jsonStr string) map[string]interface{} {
 	var config map[string]interface{}
 	err := json.Unmarshal([]byte(jsonStr), &config)
@@ -210,7 +661,7 @@ func ConvertJsonStringIntoMap(jsonStr string) map[string]interface{} {
 	return config
 }
 
-func GetRemnawaveToken() any {
+func GetRemnawaveToken() string {
 	return os.Getenv("REMNAWAVE_TOKEN")
 }
 
@@ -0,0 +1,38 @@
+package config
+
+import (
+	"testing"
+
+	"remnawave-json/internal/userselect"
+)
+
+func TestRuleSetAppliesTo(t *testing.T) {
+	vip := userselect.User{Tag: "VIP", Squads: []string{"Default", "Kazakhstan"}}
+	plain := userselect.User{Squads: []string{"Default"}}
+
+	tests := []struct {
+		name    string
+		ruleSet RuleSet
+		user    userselect.User
+		want    bool
+	}{
+		{"everyone", RuleSet{Enabled: true}, plain, true},
+		{"disabled", RuleSet{}, plain, false},
+		{"tag", RuleSet{Enabled: true, Tags: []string{"VIP"}}, vip, true},
+		{"other tag", RuleSet{Enabled: true, Tags: []string{"VIP"}}, plain, false},
+		{"any squad", RuleSet{Enabled: true, Squads: []string{"Russia", "Kazakhstan"}}, vip, true},
+		{"no squad", RuleSet{Enabled: true, Squads: []string{"Russia"}}, vip, false},
+		{"tag and squad both needed", RuleSet{Enabled: true, Tags: []string{"VIP"}, Squads: []string{"Russia"}}, vip, false},
+		{"tag and squad", RuleSet{Enabled: true, Tags: []string{"VIP"}, Squads: []string{"Kazakhstan"}}, vip, true},
+		{"excluded tag", RuleSet{Enabled: true, ExcludeTags: []string{"VIP"}}, vip, false},
+		{"excluded squad", RuleSet{Enabled: true, ExcludeSquads: []string{"Kazakhstan"}}, vip, false},
+		{"exclude wins over include", RuleSet{Enabled: true, Tags: []string{"VIP"}, ExcludeSquads: []string{"Kazakhstan"}}, vip, false},
+		{"exclude of others", RuleSet{Enabled: true, ExcludeTags: []string{"VIP"}}, plain, true},
+		{"empty tag is not excluded", RuleSet{Enabled: true, ExcludeTags: []string{""}}, plain, true},
+	}
+	for _, tt := range tests {
+		if got := tt.ruleSet.AppliesTo(tt.user); got != tt.want {
+			t.Errorf("%s: AppliesTo() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
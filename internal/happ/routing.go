@@ -0,0 +1,174 @@
+// Package happ builds the routing profiles Happ imports from the "routing"
+// response header.
+package happ
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"remnawave-json/internal/userselect"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Profile is a Happ routing profile. Field names and order follow what Happ
+// exports; booleans are sent as "true"/"false" strings.
+type Profile struct {
+	Name              string            `yaml:"name" json:"Name"`
+	GlobalProxy       bool              `yaml:"globalProxy" json:"GlobalProxy,string"`
+	RemoteDNSType     string            `yaml:"remoteDnsType" json:"RemoteDNSType"`
+	RemoteDNSDomain   string            `yaml:"remoteDnsDomain" json:"RemoteDNSDomain"`
+	RemoteDNSIP       string            `yaml:"remoteDnsIp" json:"RemoteDNSIP"`
+	DomesticDNSType   string            `yaml:"domesticDnsType" json:"DomesticDNSType"`
+	DomesticDNSDomain string            `yaml:"domesticDnsDomain" json:"DomesticDNSDomain"`
+	DomesticDNSIP     string            `yaml:"domesticDnsIp" json:"DomesticDNSIP"`
+	Geoipurl          string            `yaml:"geoipUrl" json:"Geoipurl"`
+	Geositeurl        string            `yaml:"geositeUrl" json:"Geositeurl"`
+	LastUpdated       string            `yaml:"lastUpdated" json:"LastUpdated"`
+	DnsHosts          map[string]string `yaml:"dnsHosts" json:"DnsHosts"`
+	DirectSites       []string          `yaml:"directSites" json:"DirectSites"`
+	DirectIp          []string          `yaml:"directIp" json:"DirectIp"`
+	ProxySites        []string          `yaml:"proxySites" json:"ProxySites"`
+	ProxyIp           []string          `yaml:"proxyIp" json:"ProxyIp"`
+	BlockSites        []string          `yaml:"blockSites" json:"BlockSites"`
+	BlockIp           []string          `yaml:"blockIp" json:"BlockIp"`
+	DomainStrategy    string            `yaml:"domainStrategy" json:"DomainStrategy"`
+	FakeDNS           bool              `yaml:"fakeDns" json:"FakeDNS,string"`
+	UseChunkFiles     bool              `yaml:"useChunkFiles" json:"UseChunkFiles,string"`
+}
+
+// BalancerProfile is the profile the balancer config has always been sent
+// with when no routing file is configured.
+var BalancerProfile = Profile{
+	Name:            "SEGA VPN",
+	GlobalProxy:     true,
+	RemoteDNSType:   "DoH",
+	DomesticDNSType: "DoU",
+	Geoipurl:        "https://github.com/frayZV/simple-ru-geoip/releases/latest/download/geoip.dat",
+	Geositeurl:      "https://github.com/frayZV/simple-ru-geosite/releases/latest/download/geosite.dat",
+	DomainStrategy:  "IPIfNonMatch",
+	UseChunkFiles:   true,
+}
+
+// Routing is the routing file: the import mode, the profile sent by default
+// and the profiles for particular users. Each of those starts from the
+// default and overrides only the fields it sets.
+type Routing struct {
+	Mode     string    `yaml:"mode"`
+	Default  Profile   `yaml:"default"`
+	Profiles []Variant `yaml:"profiles"`
+}
+
+// Variant is a profile for the users Match selects.
+type Variant struct {
+	Name    string              `yaml:"name"`
+	Match   userselect.Selector `yaml:"match"`
+	Profile yaml.Node           `yaml:"profile"`
+}
+
+// Routes are the encoded routing links, ready to be picked per user.
+type Routes struct {
+	Default string
+	routes  []route
+}
+
+type route struct {
+	match userselect.Selector
+	link  string
+}
+
+// Modes maps the routing file mode to the link action: onadd applies the
+// profile when the subscription is added, add only offers it.
+var Modes = map[string]bool{
+	"onadd": true,
+	"add":   true,
+}
+
+// LoadRouting reads a routing file and encodes its profiles.
+func LoadRouting(path string) (Routes, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Routes{}, err
+	}
+
+	var routing Routing
+	if err := yaml.Unmarshal(data, &routing); err != nil {
+		return Routes{}, fmt.Errorf("decoding %s: %w", path, err)
+	}
+	if routing.Mode == "" {
+		routing.Mode = "onadd"
+	}
+	if !Modes[routing.Mode] {
+		return Routes{}, fmt.Errorf("%s: unknown mode %s", path, routing.Mode)
+	}
+
+	var routes Routes
+	if routes.Default, err = routing.Default.Encode(routing.Mode); err != nil {
+		return Routes{}, err
+	}
+	for _, variant := range routing.Profiles {
+		if variant.Match.IsEmpty() {
+			return Routes{}, fmt.Errorf("%s: profile %s has an empty match", path, variant.Name)
+		}
+
+		profile := routing.Default
+		profile.DnsHosts = maps.Clone(routing.Default.DnsHosts)
+		if !variant.Profile.IsZero() {
+			if err := variant.Profile.Decode(&profile); err != nil {
+				return Routes{}, fmt.Errorf("%s: profile %s: %w", path, variant.Name, err)
+			}
+		}
+		link, err := profile.Encode(routing.Mode)
+		if err != nil {
+			return Routes{}, err
+		}
+		routes.routes = append(routes.routes, route{match: variant.Match, link: link})
+	}
+	return routes, nil
+}
+
+// Static returns routes that send link to everyone.
+func Static(link string) Routes {
+	return Routes{Default: link}
+}
+
+// For returns the link of the first profile matching user, or the default.
+func (r Routes) For(user userselect.User) string {
+	for _, route := range r.routes {
+		if route.match.Matches(user) {
+			return route.link
+		}
+	}
+	return r.Default
+}
+
+// NeedsUser reports whether picking a profile takes the user's tag or
+// squads, i.e. whether the user has to be fetched first.
+func (r Routes) NeedsUser() bool {
+	for _, route := range r.routes {
+		if route.match.NeedsUser() {
+			return true
+		}
+	}
+	return false
+}
+
+// Encode renders the profile as a happ://routing/<mode>/<base64 JSON> link.
+func (p Profile) Encode(mode string) (string, error) {
+	if p.DnsHosts == nil {
+		p.DnsHosts = map[string]string{}
+	}
+	for _, list := range []*[]string{&p.DirectSites, &p.DirectIp, &p.ProxySites, &p.ProxyIp, &p.BlockSites, &p.BlockIp} {
+		if *list == nil {
+			*list = []string{}
+		}
+	}
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("happ://routing/%s/%s", mode, base64.StdEncoding.EncodeToString(data)), nil
+}
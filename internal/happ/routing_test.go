@@ -0,0 +1,27 @@
+package happ
+
+import "testing"
+
+// baselineLink is the header the balancer config was sent with before the
+// profile was modelled.
+const baselineLink = "happ://routing/onadd/eyJOYW1lIjoiU0VHQSBWUE4iLCJHbG9iYWxQcm94eSI6InRydWUiLCJSZW1vdGVETlNUeXBlIjoiRG9IIiwiUmVtb3RlRE5TRG9tYWluIjoiIiwiUmVtb3RlRE5TSVAiOiIiLCJEb21lc3RpY0ROU1R5cGUiOiJEb1UiLCJEb21lc3RpY0ROU0RvbWFpbiI6IiIsIkRvbWVzdGljRE5TSVAiOiIiLCJHZW9pcHVybCI6Imh0dHBzOi8vZ2l0aHViLmNvbS9mcmF5WlYvc2ltcGxlLXJ1LWdlb2lwL3JlbGVhc2VzL2xhdGVzdC9kb3dubG9hZC9nZW9pcC5kYXQiLCJHZW9zaXRldXJsIjoiaHR0cHM6Ly9naXRodWIuY29tL2ZyYXlaVi9zaW1wbGUtcnUtZ2Vvc2l0ZS9yZWxlYXNlcy9sYXRlc3QvZG93bmxvYWQvZ2Vvc2l0ZS5kYXQiLCJMYXN0VXBkYXRlZCI6IiIsIkRuc0hvc3RzIjp7fSwiRGlyZWN0U2l0ZXMiOltdLCJEaXJlY3RJcCI6W10sIlByb3h5U2l0ZXMiOltdLCJQcm94eUlwIjpbXSwiQmxvY2tTaXRlcyI6W10sIkJsb2NrSXAiOltdLCJEb21haW5TdHJhdGVneSI6IklQSWZOb25NYXRjaCIsIkZha2VETlMiOiJmYWxzZSIsIlVzZUNodW5rRmlsZXMiOiJ0cnVlIn0="
+
+func TestBalancerProfileMatchesBaseline(t *testing.T) {
+	link, err := BalancerProfile.Encode("onadd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link != baselineLink {
+		t.Errorf("BalancerProfile.Encode() =\n%s\nwant\n%s", link, baselineLink)
+	}
+}
+
+func TestSampleRouting(t *testing.T) {
+	routes, err := LoadRouting("../../templates/happ/routing.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if routes.Default != baselineLink {
+		t.Errorf("sample default =\n%s\nwant\n%s", routes.Default, baselineLink)
+	}
+}
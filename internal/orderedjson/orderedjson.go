@@ -0,0 +1,246 @@
+// Package orderedjson decodes and encodes JSON without losing the key order
+// of objects or the literal form of numbers, so documents can be rewritten
+// without reshuffling everything the rewrite did not touch.
+package orderedjson
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Object is a JSON object that remembers the order of its keys.
+type Object struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func NewObject() *Object {
+	return &Object{values: make(map[string]interface{})}
+}
+
+func (o *Object) Get(key string) (interface{}, bool) {
+	v, ok := o.values[key]
+	return v, ok
+}
+
+// Set replaces the value of an existing key in place or appends a new one.
+func (o *Object) Set(key string, value interface{}) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+func (o *Object) Delete(key string) {
+	if _, ok := o.values[key]; !ok {
+		return
+	}
+	delete(o.values, key)
+	for i, k := range o.keys {
+		if k == key {
+			o.keys = append(o.keys[:i], o.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+func (o *Object) Keys() []string {
+	return o.keys
+}
+
+func (o *Object) Len() int {
+	return len(o.keys)
+}
+
+func (o *Object) MarshalJSON() ([]byte, error) {
+	return Marshal(o)
+}
+
+// Unmarshal decodes data into *Object, []interface{}, json.Number, string,
+// bool or nil values.
+func Unmarshal(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	v, err := decodeValue(dec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("orderedjson: unexpected data after top-level value")
+	}
+	return v, nil
+}
+
+func decodeValue(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch t := tok.(type) {
+	case json.Delim:
+		switch t {
+		case '{':
+			obj := NewObject()
+			for dec.More() {
+				keyTok, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				key, ok := keyTok.(string)
+				if !ok {
+					return nil, fmt.Errorf("orderedjson: unexpected object key %v", keyTok)
+				}
+				value, err := decodeValue(dec)
+				if err != nil {
+					return nil, err
+				}
+				obj.Set(key, value)
+			}
+			if _, err := dec.Token(); err != nil {
+				return nil, err
+			}
+			return obj, nil
+		case '[':
+			arr := []interface{}{}
+			for dec.More() {
+				value, err := decodeValue(dec)
+				if err != nil {
+					return nil, err
+				}
+				arr = append(arr, value)
+			}
+			if _, err := dec.Token(); err != nil {
+				return nil, err
+			}
+			return arr, nil
+		}
+		return nil, fmt.Errorf("orderedjson: unexpected delimiter %v", t)
+	default:
+		return t, nil
+	}
+}
+
+// Marshal encodes v compactly, without HTML escaping and without a trailing
+// newline.
+func Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := encodeValue(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func encodeValue(buf *bytes.Buffer, v interface{}) error {
+	switch t := v.(type) {
+	case *Object:
+		buf.WriteByte('{')
+		for i, key := range t.keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := encodeScalar(buf, key); err != nil {
+				return err
+			}
+			buf.WriteByte(':')
+			if err := encodeValue(buf, t.values[key]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, item := range t {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := encodeValue(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	default:
+		return encodeScalar(buf, v)
+	}
+	return nil
+}
+
+func encodeScalar(buf *bytes.Buffer, v interface{}) error {
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	buf.Write(bytes.TrimSuffix(out.Bytes(), []byte("\n")))
+	return nil
+}
+
+// Rewrite decodes original, applies transform and encodes the result with the
+// indentation and trailing whitespace of original.
+func Rewrite(original []byte, transform func(interface{}) interface{}) ([]byte, error) {
+	data, err := Unmarshal(original)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := Marshal(transform(data))
+	if err != nil {
+		return nil, err
+	}
+
+	if indent := detectIndent(original); indent != "" {
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, out, "", indent); err != nil {
+			return nil, err
+		}
+		out = buf.Bytes()
+	}
+
+	trimmed := bytes.TrimRight(original, " \t\r\n")
+	return append(out, original[len(trimmed):]...), nil
+}
+
+// detectIndent returns the whitespace that opens the second line of data, or
+// "" when data is compact.
+func detectIndent(data []byte) string {
+	data = bytes.TrimLeft(data, " \t\r\n")
+	nl := bytes.IndexByte(data, '\n')
+	if nl < 0 {
+		return ""
+	}
+	rest := data[nl+1:]
+	end := 0
+	for end < len(rest) && (rest[end] == ' ' || rest[end] == '\t') {
+		end++
+	}
+	return string(rest[:end])
+}
+
+// MergePatch applies an RFC 7396 merge patch to target. Existing keys keep
+// their position and new keys are appended in patch order.
+func MergePatch(target, patch interface{}) interface{} {
+	patchObj, ok := patch.(*Object)
+	if !ok {
+		return patch
+	}
+
+	targetObj, ok := target.(*Object)
+	if !ok {
+		targetObj = NewObject()
+	}
+	for _, key := range patchObj.keys {
+		value := patchObj.values[key]
+		if value == nil {
+			targetObj.Delete(key)
+			continue
+		}
+		current, _ := targetObj.Get(key)
+		targetObj.Set(key, MergePatch(current, value))
+	}
+	return targetObj
+}
@@ -0,0 +1,103 @@
+package orderedjson
+
+import "testing"
+
+func TestRoundTrip(t *testing.T) {
+	tests := []string{
+		`{"z":1,"a":2,"m":{"y":true,"b":null}}`,
+		`[{"port":443,"ratio":1.50,"big":12345678901234567890}]`,
+		`{"path":"/ws?ed=2048&x=<y>","empty":{},"list":[]}`,
+	}
+	for _, input := range tests {
+		data, err := Unmarshal([]byte(input))
+		if err != nil {
+			t.Fatalf("Unmarshal(%s): %v", input, err)
+		}
+		out, err := Marshal(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != input {
+			t.Errorf("round trip of\n%s\ngave\n%s", input, out)
+		}
+	}
+}
+
+func TestUnmarshalRejectsTrailingData(t *testing.T) {
+	if _, err := Unmarshal([]byte(`{"a":1} {"b":2}`)); err == nil {
+		t.Error("Unmarshal accepted two top-level values")
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		name, target, patch, want string
+	}{
+		{"replaces in place", `{"a":1,"b":2,"c":3}`, `{"b":20}`, `{"a":1,"b":20,"c":3}`},
+		{"appends new keys in patch order", `{"b":1}`, `{"z":1,"a":2}`, `{"b":1,"z":1,"a":2}`},
+		{"null deletes", `{"a":1,"b":2,"c":3}`, `{"b":null,"x":null}`, `{"a":1,"c":3}`},
+		{"merges nested objects", `{"dns":{"servers":["1.1.1.1"],"tag":"dns"},"log":{}}`, `{"dns":{"tag":null,"hosts":{"a":"b"}}}`, `{"dns":{"servers":["1.1.1.1"],"hosts":{"a":"b"}},"log":{}}`},
+		{"replaces arrays", `{"a":[1,2,3]}`, `{"a":[4]}`, `{"a":[4]}`},
+		{"object over scalar", `{"a":"x"}`, `{"a":{"b":null,"c":1}}`, `{"a":{"c":1}}`},
+		{"non-object patch replaces", `{"a":1}`, `[1]`, `[1]`},
+	}
+	for _, tt := range tests {
+		target, err := Unmarshal([]byte(tt.target))
+		if err != nil {
+			t.Fatal(err)
+		}
+		patch, err := Unmarshal([]byte(tt.patch))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := Marshal(MergePatch(target, patch))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != tt.want {
+			t.Errorf("%s: MergePatch() = %s, want %s", tt.name, out, tt.want)
+		}
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	setRemarks := func(v interface{}) interface{} {
+		v.(*Object).Set("remarks", "DE")
+		return v
+	}
+
+	tests := []struct {
+		name, input, want string
+	}{
+		{"compact", `{"z":1,"remarks":"NL","a":[1,2]}`, `{"z":1,"remarks":"DE","a":[1,2]}`},
+		{"two spaces and trailing newline", "{\n  \"z\": 1,\n  \"remarks\": \"NL\",\n  \"a\": [\n    1\n  ]\n}\n", "{\n  \"z\": 1,\n  \"remarks\": \"DE\",\n  \"a\": [\n    1\n  ]\n}\n"},
+		{"tabs", "{\n\t\"z\": 1.0,\n\t\"remarks\": \"NL\"\n}", "{\n\t\"z\": 1.0,\n\t\"remarks\": \"DE\"\n}"},
+		{"appended key", "{\n    \"z\": 1\n}\r\n", "{\n    \"z\": 1,\n    \"remarks\": \"DE\"\n}\r\n"},
+	}
+	for _, tt := range tests {
+		out, err := Rewrite([]byte(tt.input), setRemarks)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if string(out) != tt.want {
+			t.Errorf("%s: Rewrite() =\n%q\nwant\n%q", tt.name, out, tt.want)
+		}
+	}
+}
+
+func TestObjectDelete(t *testing.T) {
+	obj := NewObject()
+	for _, key := range []string{"a", "b", "c"} {
+		obj.Set(key, key)
+	}
+	obj.Delete("b")
+	obj.Delete("missing")
+	obj.Set("b", "again")
+	out, err := Marshal(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != `{"a":"a","c":"c","b":"again"}` {
+		t.Errorf("after Delete and Set = %s", out)
+	}
+}
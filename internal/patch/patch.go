@@ -0,0 +1,139 @@
+// Package patch tweaks generated client configs for selected users with
+// JSON Patch (RFC 6902) and JSON Merge Patch (RFC 7396) documents.
+package patch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"remnawave-json/internal/orderedjson"
+	"remnawave-json/internal/userselect"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+)
+
+// Patch is one step of the pipeline, applied to the users Match selects.
+// Exactly one of JSONPatch and MergePatch is set.
+type Patch struct {
+	Name       string              `json:"name"`
+	Match      userselect.Selector `json:"match"`
+	JSONPatch  json.RawMessage     `json:"jsonPatch,omitempty"`
+	MergePatch json.RawMessage     `json:"mergePatch,omitempty"`
+
+	ops jsonpatch.Patch
+}
+
+// Load reads an ordered list of patches, rejecting ones that cannot be
+// decoded.
+func Load(path string) ([]Patch, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var patches []Patch
+	if err := json.Unmarshal(data, &patches); err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", path, err)
+	}
+	return Compile(patches)
+}
+
+// Compile decodes the patch documents ahead of use.
+func Compile(patches []Patch) ([]Patch, error) {
+	compiled := make([]Patch, len(patches))
+	for i, p := range patches {
+		switch {
+		case len(p.JSONPatch) > 0 && len(p.MergePatch) > 0:
+			return nil, fmt.Errorf("patch %s: jsonPatch and mergePatch are mutually exclusive", p.Name)
+		case len(p.JSONPatch) > 0:
+			ops, err := jsonpatch.DecodePatch(p.JSONPatch)
+			if err != nil {
+				return nil, fmt.Errorf("patch %s: %w", p.Name, err)
+			}
+			p.ops = ops
+		case len(p.MergePatch) > 0:
+			if _, err := orderedjson.Unmarshal(p.MergePatch); err != nil {
+				return nil, fmt.Errorf("patch %s: %w", p.Name, err)
+			}
+		default:
+			return nil, fmt.Errorf("patch %s: jsonPatch or mergePatch is required", p.Name)
+		}
+		compiled[i] = p
+	}
+	return compiled, nil
+}
+
+// NeedsUser reports whether matching the patches takes more than the
+// shortUuid and client, i.e. whether the user has to be fetched first.
+func NeedsUser(patches []Patch) bool {
+	for _, p := range patches {
+		if p.Match.NeedsUser() {
+			return true
+		}
+	}
+	return false
+}
+
+// Select returns, in order, the patches matching user.
+func Select(patches []Patch, user userselect.User) []Patch {
+	var selected []Patch
+	for _, p := range patches {
+		if p.Match.Matches(user) {
+			selected = append(selected, p)
+		}
+	}
+	return selected
+}
+
+// Apply runs the patches, in order, against every element of a v2ray-json
+// array, or against data itself when it is a single config. A patch that
+// fails on an element leaves that element unchanged and is reported in the
+// returned error.
+func Apply(patches []Patch, data interface{}) (interface{}, error) {
+	var errs []error
+	for _, p := range patches {
+		arr, ok := data.([]interface{})
+		if !ok {
+			var err error
+			if data, err = p.apply(data); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		for i, item := range arr {
+			patched, err := p.apply(item)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("element %d: %w", i, err))
+				continue
+			}
+			arr[i] = patched
+		}
+	}
+	return data, errors.Join(errs...)
+}
+
+func (p Patch) apply(doc interface{}) (interface{}, error) {
+	if p.ops == nil {
+		// Decoded per use so no two configs share the patch's values.
+		merge, err := orderedjson.Unmarshal(p.MergePatch)
+		if err != nil {
+			return doc, fmt.Errorf("patch %s: %w", p.Name, err)
+		}
+		return orderedjson.MergePatch(doc, merge), nil
+	}
+
+	raw, err := orderedjson.Marshal(doc)
+	if err != nil {
+		return doc, fmt.Errorf("patch %s: %w", p.Name, err)
+	}
+	patched, err := p.ops.Apply(raw)
+	if err != nil {
+		return doc, fmt.Errorf("patch %s: %w", p.Name, err)
+	}
+	result, err := orderedjson.Unmarshal(patched)
+	if err != nil {
+		return doc, fmt.Errorf("patch %s: %w", p.Name, err)
+	}
+	return result, nil
+}
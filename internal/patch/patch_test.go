@@ -0,0 +1,208 @@
+package patch
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"remnawave-json/internal/orderedjson"
+	"remnawave-json/internal/userselect"
+)
+
+// compile decodes and compiles a patches.json document.
+func compile(t *testing.T, doc string) []Patch {
+	t.Helper()
+	var patches []Patch
+	if err := json.Unmarshal([]byte(doc), &patches); err != nil {
+		t.Fatal(err)
+	}
+	compiled, err := Compile(patches)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return compiled
+}
+
+// apply runs the patches against input and returns the compact result.
+func apply(t *testing.T, patches []Patch, input string) (string, error) {
+	t.Helper()
+	data, err := orderedjson.Unmarshal([]byte(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, applyErr := Apply(patches, data)
+	out, err := orderedjson.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out), applyErr
+}
+
+const config = `{"remarks":"NL","dns":{"servers":["1.1.1.1"]},"routing":{"domainStrategy":"AsIs","rules":[{"outboundTag":"direct"}]},"outbounds":[{"tag":"proxy"}]}`
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name    string
+		patches string
+		input   string
+		want    string
+		wantErr string
+	}{
+		{
+			name:    "json patch add, replace and remove",
+			patches: `[{"name":"p","jsonPatch":[{"op":"add","path":"/routing/rules/0","value":{"outboundTag":"block"}},{"op":"replace","path":"/routing/domainStrategy","value":"IPIfNonMatch"},{"op":"remove","path":"/dns"}]}]`,
+			input:   config,
+			want:    `{"remarks":"NL","routing":{"domainStrategy":"IPIfNonMatch","rules":[{"outboundTag":"block"},{"outboundTag":"direct"}]},"outbounds":[{"tag":"proxy"}]}`,
+		},
+		{
+			name:    "json patch test op passes",
+			patches: `[{"name":"p","jsonPatch":[{"op":"test","path":"/remarks","value":"NL"},{"op":"add","path":"/outbounds/-","value":{"tag":"direct"}}]}]`,
+			input:   config,
+			want:    `{"remarks":"NL","dns":{"servers":["1.1.1.1"]},"routing":{"domainStrategy":"AsIs","rules":[{"outboundTag":"direct"}]},"outbounds":[{"tag":"proxy"},{"tag":"direct"}]}`,
+		},
+		{
+			name:    "failing test op leaves the config unchanged",
+			patches: `[{"name":"only-de","jsonPatch":[{"op":"test","path":"/remarks","value":"DE"},{"op":"remove","path":"/dns"}]}]`,
+			input:   config,
+			want:    config,
+			wantErr: "patch only-de",
+		},
+		{
+			name:    "remove of a missing path fails",
+			patches: `[{"name":"no-fakedns","jsonPatch":[{"op":"remove","path":"/fakedns"}]}]`,
+			input:   config,
+			want:    config,
+			wantErr: "patch no-fakedns",
+		},
+		{
+			name:    "merge patch deletes nulls and merges nested objects",
+			patches: `[{"name":"m","mergePatch":{"dns":null,"routing":{"domainStrategy":"IPOnDemand","balancers":[{"tag":"b"}]},"log":{"loglevel":"warning"}}}]`,
+			input:   config,
+			want:    `{"remarks":"NL","routing":{"domainStrategy":"IPOnDemand","rules":[{"outboundTag":"direct"}],"balancers":[{"tag":"b"}]},"outbounds":[{"tag":"proxy"}],"log":{"loglevel":"warning"}}`,
+		},
+		{
+			name:    "merge patch replaces arrays",
+			patches: `[{"name":"m","mergePatch":{"dns":{"servers":["8.8.8.8","1.1.1.1"]}}}]`,
+			input:   `{"dns":{"servers":["1.1.1.1"],"queryStrategy":"UseIPv4"}}`,
+			want:    `{"dns":{"servers":["8.8.8.8","1.1.1.1"],"queryStrategy":"UseIPv4"}}`,
+		},
+		{
+			name:    "every element of an array config",
+			patches: `[{"name":"m","mergePatch":{"log":{"loglevel":"none"}}}]`,
+			input:   `[{"remarks":"NL"},{"remarks":"DE","log":{"access":"none"}}]`,
+			want:    `[{"remarks":"NL","log":{"loglevel":"none"}},{"remarks":"DE","log":{"access":"none","loglevel":"none"}}]`,
+		},
+		{
+			name:    "a failing element keeps the others patched",
+			patches: `[{"name":"nl","jsonPatch":[{"op":"test","path":"/remarks","value":"NL"},{"op":"add","path":"/tag","value":"nl"}]}]`,
+			input:   `[{"remarks":"NL"},{"remarks":"DE"}]`,
+			want:    `[{"remarks":"NL","tag":"nl"},{"remarks":"DE"}]`,
+			wantErr: "element 1: patch nl",
+		},
+		{
+			name: "patches apply in order",
+			patches: `[
+				{"name":"first","mergePatch":{"routing":{"domainStrategy":"IPIfNonMatch"}}},
+				{"name":"second","jsonPatch":[{"op":"test","path":"/routing/domainStrategy","value":"IPIfNonMatch"},{"op":"replace","path":"/routing/domainStrategy","value":"IPOnDemand"}]},
+				{"name":"third","mergePatch":{"remarks":"NL2"}}
+			]`,
+			input: config,
+			want:  `{"remarks":"NL2","dns":{"servers":["1.1.1.1"]},"routing":{"domainStrategy":"IPOnDemand","rules":[{"outboundTag":"direct"}]},"outbounds":[{"tag":"proxy"}]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := apply(t, compile(t, tt.patches), tt.input)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("Apply() error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("Apply() error = %v, want one containing %q", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Apply() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyDoesNotShareMergeValues(t *testing.T) {
+	patches := compile(t, `[{"name":"m","mergePatch":{"log":{"loglevel":"none"}}}]`)
+	data, err := orderedjson.Unmarshal([]byte(`[{},{}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Apply(patches, data); err != nil {
+		t.Fatal(err)
+	}
+
+	arr := data.([]interface{})
+	first, _ := arr[0].(*orderedjson.Object).Get("log")
+	first.(*orderedjson.Object).Set("loglevel", "debug")
+	second, _ := arr[1].(*orderedjson.Object).Get("log")
+	if level, _ := second.(*orderedjson.Object).Get("loglevel"); level != "none" {
+		t.Errorf("second config loglevel = %v after editing the first, want none", level)
+	}
+}
+
+func TestCompileRejects(t *testing.T) {
+	tests := map[string]string{
+		"neither":     `[{"name":"p"}]`,
+		"both":        `[{"name":"p","jsonPatch":[],"mergePatch":{}}]`,
+		"unknown op":  `[{"name":"p","jsonPatch":[{"op":"frobnicate","path":"/a"}]}]`,
+		"not a patch": `[{"name":"p","jsonPatch":{"op":"add"}}]`,
+	}
+	for name, doc := range tests {
+		var patches []Patch
+		if err := json.Unmarshal([]byte(doc), &patches); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, err := Compile(patches); err == nil {
+			t.Errorf("%s: Compile() = nil error, want error", name)
+		}
+	}
+}
+
+func TestSelect(t *testing.T) {
+	patches := compile(t, `[
+		{"name":"all","mergePatch":{}},
+		{"name":"uuid","match":{"shortUuids":["c11JfduMqrkBZrTZ"]},"mergePatch":{}},
+		{"name":"username","match":{"usernames":["acme"]},"mergePatch":{}},
+		{"name":"tag","match":{"tags":["VIP"]},"mergePatch":{}},
+		{"name":"squad","match":{"squads":["Kazakhstan"]},"mergePatch":{}},
+		{"name":"client","match":{"clients":["happ"]},"mergePatch":{}},
+		{"name":"vip-happ","match":{"tags":["VIP"],"clients":["Happ"]},"mergePatch":{}}
+	]`)
+
+	tests := []struct {
+		name string
+		user userselect.User
+		want []string
+	}{
+		{"nobody in particular", userselect.User{ShortUuid: "x", Client: "Streisand"}, []string{"all"}},
+		{"shortUuid", userselect.User{ShortUuid: "c11JfduMqrkBZrTZ"}, []string{"all", "uuid"}},
+		{"username", userselect.User{Username: "acme"}, []string{"all", "username"}},
+		{"tag", userselect.User{Tag: "VIP"}, []string{"all", "tag"}},
+		{"squad", userselect.User{Squads: []string{"Default", "Kazakhstan"}}, []string{"all", "squad"}},
+		{"client", userselect.User{Client: "Happ"}, []string{"all", "client"}},
+		{"tag and client", userselect.User{Tag: "VIP", Client: "Happ"}, []string{"all", "tag", "client", "vip-happ"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, p := range Select(patches, tt.user) {
+			got = append(got, p.Name)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: Select() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNeedsUser(t *testing.T) {
+	if NeedsUser(compile(t, `[{"name":"p","match":{"shortUuids":["a"],"clients":["Happ"]},"mergePatch":{}}]`)) {
+		t.Error("NeedsUser() = true for shortUuid and client selectors")
+	}
+	if !NeedsUser(compile(t, `[{"name":"p","mergePatch":{}},{"name":"q","match":{"squads":["KZ"]},"mergePatch":{}}]`)) {
+		t.Error("NeedsUser() = false with a squad selector")
+	}
+}
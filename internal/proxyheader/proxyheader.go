@@ -0,0 +1,88 @@
+package proxyheader
+
+import (
+	"net/http"
+	"remnawave-json/internal/config"
+	"strings"
+)
+
+// hopByHop headers are meaningful for a single connection only (RFC 7230,
+// section 6.1) and are never forwarded.
+var hopByHop = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// requestDenied are client headers the panel must never see.
+var requestDenied = []string{
+	"Authorization",
+	"Cookie",
+	"Host",
+	"X-Api-Key",
+	"Content-Length",
+}
+
+// responseDenied are panel headers clients must never see. Content-Length is
+// dropped because the body may be decompressed or rewritten on the way.
+var responseDenied = []string{
+	"Set-Cookie",
+	"Server",
+	"Via",
+	"X-Powered-By",
+	"Content-Length",
+}
+
+// CopyRequest copies client headers onto a panel request.
+func CopyRequest(dst, src http.Header) {
+	copyFiltered(dst, src, requestDenied, config.GetRequestHeaderDenylist())
+}
+
+// CopyResponse copies panel headers onto the client response.
+func CopyResponse(dst, src http.Header) {
+	copyFiltered(dst, src, responseDenied, config.GetResponseHeaderDenylist())
+}
+
+// CopyResponseMap copies single-valued panel headers, as the raw
+// subscription reports them, onto the client response.
+func CopyResponseMap(dst http.Header, src map[string]string) {
+	header := make(http.Header, len(src))
+	for key, value := range src {
+		header.Set(key, value)
+	}
+	CopyResponse(dst, header)
+}
+
+func copyFiltered(dst, src http.Header, denied ...[]string) {
+	skip := make(map[string]bool)
+	for _, name := range hopByHop {
+		skip[name] = true
+	}
+	for _, list := range denied {
+		for _, name := range list {
+			skip[http.CanonicalHeaderKey(name)] = true
+		}
+	}
+	for _, value := range src.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				skip[http.CanonicalHeaderKey(name)] = true
+			}
+		}
+	}
+
+	for key, values := range src {
+		if skip[http.CanonicalHeaderKey(key)] {
+			continue
+		}
+		for _, value := range values {
+			dst.Add(key, value)
+		}
+	}
+}
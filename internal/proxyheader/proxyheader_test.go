@@ -0,0 +1,85 @@
+package proxyheader
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestCopyResponse(t *testing.T) {
+	src := http.Header{
+		"Content-Type":          {"application/json"},
+		"Profile-Title":         {"base64:VGVzdA=="},
+		"Subscription-Userinfo": {"upload=0; download=0"},
+		"Connection":            {"keep-alive, X-Panel-Trace"},
+		"X-Panel-Trace":         {"abc"},
+		"Keep-Alive":            {"timeout=5"},
+		"Transfer-Encoding":     {"chunked"},
+		"Set-Cookie":            {"session=1"},
+		"Server":                {"nginx"},
+		"Content-Length":        {"42"},
+	}
+	dst := http.Header{}
+	CopyResponse(dst, src)
+
+	want := http.Header{
+		"Content-Type":          {"application/json"},
+		"Profile-Title":         {"base64:VGVzdA=="},
+		"Subscription-Userinfo": {"upload=0; download=0"},
+	}
+	if !reflect.DeepEqual(dst, want) {
+		t.Errorf("CopyResponse() = %v, want %v", dst, want)
+	}
+}
+
+func TestCopyResponseMap(t *testing.T) {
+	dst := http.Header{}
+	CopyResponseMap(dst, map[string]string{
+		"profile-title": "Test",
+		"connection":    "close",
+		"set-cookie":    "session=1",
+	})
+
+	want := http.Header{"Profile-Title": {"Test"}}
+	if !reflect.DeepEqual(dst, want) {
+		t.Errorf("CopyResponseMap() = %v, want %v", dst, want)
+	}
+}
+
+func TestCopyRequest(t *testing.T) {
+	src := http.Header{
+		"User-Agent":    {"Happ/1.9.2/ios"},
+		"X-Hwid":        {"device"},
+		"Authorization": {"Bearer token"},
+		"Cookie":        {"session=1"},
+		"X-Api-Key":     {"secret"},
+		"Upgrade":       {"websocket"},
+	}
+	dst := http.Header{}
+	CopyRequest(dst, src)
+
+	want := http.Header{
+		"User-Agent": {"Happ/1.9.2/ios"},
+		"X-Hwid":     {"device"},
+	}
+	if !reflect.DeepEqual(dst, want) {
+		t.Errorf("CopyRequest() = %v, want %v", dst, want)
+	}
+}
+
+// The REQUEST_HEADERS_DENYLIST and RESPONSE_HEADERS_DENYLIST lists are passed
+// to copyFiltered next to the built-in ones, in any case.
+func TestCopyFilteredDenylist(t *testing.T) {
+	src := http.Header{
+		"Profile-Title":  {"Test"},
+		"Support-Url":    {"https://panel.example"},
+		"X-Panel-Region": {"eu"},
+	}
+	dst := http.Header{}
+	copyFiltered(dst, src, responseDenied, []string{"support-url", "X-PANEL-REGION"})
+
+	want := http.Header{"Profile-Title": {"Test"}}
+	if !reflect.DeepEqual(dst, want) {
+		t.Errorf("copyFiltered() = %v, want %v", dst, want)
+	}
+}
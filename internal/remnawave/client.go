@@ -0,0 +1,169 @@
+package remnawave
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"remnawave-json/internal/config"
+	"remnawave-json/internal/proxyheader"
+	"sync"
+)
+
+// Kinds of panel errors, matched with errors.Is.
+var (
+	ErrNotFound     = errors.New("subscription not found")
+	ErrGone         = errors.New("subscription revoked")
+	ErrUnauthorized = errors.New("panel rejected credentials")
+	ErrUpstream     = errors.New("panel request failed")
+	ErrDecode       = errors.New("panel response is malformed")
+)
+
+// APIError describes a failed panel call. Kind is one of the Err* values
+// above, StatusCode is the panel status when one was received.
+type APIError struct {
+	Kind       error
+	Endpoint   string
+	StatusCode int
+	Err        error
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("%s: %s", e.Endpoint, e.Kind)
+	if e.StatusCode != 0 {
+		msg += fmt.Sprintf(" (status %d)", e.StatusCode)
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *APIError) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Kind}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+// Client talks to the Remnawave panel API.
+type Client struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+func NewClient(baseURL, token string, httpClient *http.Client) *Client {
+	return &Client{baseURL: baseURL, token: token, httpClient: httpClient}
+}
+
+var (
+	defaultClient     *Client
+	defaultClientOnce sync.Once
+)
+
+// GetClient returns the client built from the loaded config.
+func GetClient() *Client {
+	defaultClientOnce.Do(func() {
+		defaultClient = NewClient(config.GetRemnaweveURL(), config.GetRemnawaveToken(), config.GetHttpClient())
+	})
+	return defaultClient
+}
+
+// Subscription forwards a request to /api/sub/{shortUuid}[/{format}] and
+// returns the panel response as is, whatever its status.
+func (c *Client) Subscription(ctx context.Context, method, shortUuid, format string, body io.Reader, header http.Header) (*http.Response, error) {
+	url := c.baseURL + "/api/sub/" + shortUuid
+	if format != "" {
+		url += "/" + format
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, &APIError{Kind: ErrUpstream, Endpoint: "subscription", Err: err}
+	}
+	proxyheader.CopyRequest(httpReq.Header, header)
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, &APIError{Kind: ErrUpstream, Endpoint: "subscription", Err: err}
+	}
+	return resp, nil
+}
+
+// SubscriptionInfo fetches /api/sub/{shortUuid}/info.
+func (c *Client) SubscriptionInfo(ctx context.Context, shortUuid, userAgent string) (*SubscriptionResponse, error) {
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set("User-Agent", userAgent)
+
+	response := &ResponseWrapper{}
+	if err := c.getJSON(ctx, "subscription info", "/api/sub/"+shortUuid+"/info", header, response); err != nil {
+		return nil, err
+	}
+	if !response.Response.IsFound {
+		return nil, &APIError{Kind: ErrNotFound, Endpoint: "subscription info"}
+	}
+
+	return &response.Response, nil
+}
+
+// RawSubscription fetches the typed raw hosts of a user, authorised with the
+// panel token.
+func (c *Client) RawSubscription(ctx context.Context, shortUuid string, clientHeader http.Header) (*ResponseConverterWrapper, error) {
+	slog.Info("Making request to raw subscription", "shortUuid", shortUuid)
+
+	header := http.Header{}
+	proxyheader.CopyRequest(header, clientHeader)
+	header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		header.Set("Authorization", fmt.Sprintf("Bearer %s", c.token))
+	}
+
+	var wrapper ResponseConverterWrapper
+	if err := c.getJSON(ctx, "raw subscription", "/api/subscriptions/by-short-uuid/"+shortUuid+"/raw", header, &wrapper); err != nil {
+		return nil, err
+	}
+
+	return &wrapper, nil
+}
+
+func (c *Client) getJSON(ctx context.Context, endpoint, path string, header http.Header, target interface{}) error {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+path, nil)
+	if err != nil {
+		return &APIError{Kind: ErrUpstream, Endpoint: endpoint, Err: err}
+	}
+	httpReq.Header = header
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return &APIError{Kind: ErrUpstream, Endpoint: endpoint, Err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		slog.Error("error while getting subscription", slog.String("endpoint", endpoint), slog.Int("status", resp.StatusCode))
+		return &APIError{Kind: statusKind(resp.StatusCode), Endpoint: endpoint, StatusCode: resp.StatusCode}
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(target); err != nil {
+		return &APIError{Kind: ErrDecode, Endpoint: endpoint, StatusCode: resp.StatusCode, Err: err}
+	}
+	return nil
+}
+
+func statusKind(status int) error {
+	switch status {
+	case http.StatusNotFound:
+		return ErrNotFound
+	case http.StatusGone:
+		return ErrGone
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrUnauthorized
+	default:
+		return ErrUpstream
+	}
+}
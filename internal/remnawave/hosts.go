@@ -0,0 +1,141 @@
+package remnawave
+
+import (
+	"errors"
+	"fmt"
+	"remnawave-json/internal/useragent"
+	"slices"
+	"strconv"
+)
+
+// Defaults for what the panel may leave empty on a host.
+const (
+	defaultSSMethod    = "chacha20-ietf-poly1305"
+	defaultFingerprint = "chrome"
+)
+
+var (
+	errNoHosts            = errors.New("no raw hosts found in response")
+	errNoConvertibleHosts = errors.New("no convertible hosts found in response")
+)
+
+// hostNaming picks how converted hosts are tagged. The zero value tags them
+// proxy1, proxy2 and so on, which BALANCER_COSTS refer to.
+type hostNaming struct {
+	// byRemark tags hosts by their remarks, made unique, for clients that
+	// show them.
+	byRemark bool
+	// reserved are tags the template already uses.
+	reserved []string
+}
+
+// hostSupport describes what a converter can express. Every converter handles
+// vless, trojan and shadowsocks over tcp with reality, tls or no security.
+type hostSupport struct {
+	// networks are the transports supported besides tcp.
+	networks []string
+	// tcpHTTPHeader allows vless and trojan over tcp with an http header.
+	tcpHTTPHeader bool
+	// ssTransports allows shadowsocks over other transports than tcp.
+	ssTransports bool
+	// client, when set, leaves out hosts using features it doesn't support.
+	client *useragent.Client
+}
+
+// check returns why the host can't be converted, or nil.
+func (s hostSupport) check(host RawHost) error {
+	if host.DbData.IsDisabled || host.DbData.IsHidden {
+		return errors.New("hidden or disabled")
+	}
+
+	switch host.Protocol {
+	case "vless", "trojan", "shadowsocks":
+	default:
+		return fmt.Errorf("unsupported protocol %s", host.Protocol)
+	}
+
+	switch {
+	case host.Network == "tcp" || host.Network == "raw":
+		if host.HeaderType != nil && *host.HeaderType == "http" && !s.tcpHTTPHeader && host.Protocol != "shadowsocks" {
+			return fmt.Errorf("unsupported tcp header %s", *host.HeaderType)
+		}
+	case !slices.Contains(s.networks, host.Network):
+		return fmt.Errorf("unsupported network %s", host.Network)
+	case host.Protocol == "shadowsocks" && !s.ssTransports:
+		return fmt.Errorf("unsupported network %s for shadowsocks", host.Network)
+	}
+	if host.Network == "xhttp" && s.client != nil && !s.client.Supports(useragent.XHTTP) {
+		return errors.New("client does not support xhttp")
+	}
+
+	switch host.TLS {
+	case "reality", "tls", "", "none":
+	default:
+		return fmt.Errorf("unsupported security %s", host.TLS)
+	}
+	return nil
+}
+
+// convertHosts builds a value for every host the converter supports, tagged
+// as naming says, and records the rest as skipped. The remark of the first
+// converted host is returned alongside.
+func convertHosts[T any](hosts []RawHost, support hostSupport, naming hostNaming, build func(RawHost, string) T) ([]T, string, []SkippedHost, error) {
+	if len(hosts) == 0 {
+		return nil, "", nil, errNoHosts
+	}
+
+	var converted []T
+	var skipped []SkippedHost
+	remarks := ""
+	used := make(map[string]bool)
+	for _, tag := range naming.reserved {
+		used[tag] = true
+	}
+	for i, host := range hosts {
+		if err := support.check(host); err != nil {
+			skipped = append(skipped, SkippedHost{Index: i + 1, Remark: host.Remark, Reason: err.Error()})
+			continue
+		}
+
+		tag := "proxy" + strconv.Itoa(len(converted)+1)
+		if naming.byRemark && host.Remark != "" {
+			tag = host.Remark
+		}
+		converted = append(converted, build(host, uniqueName(used, tag)))
+		if remarks == "" {
+			remarks = host.Remark
+		}
+	}
+	if len(converted) == 0 {
+		return nil, "", skipped, errNoConvertibleHosts
+	}
+	return converted, remarks, skipped, nil
+}
+
+// uniqueName returns name, or name with the first free " N" suffix when it is
+// already used, and marks the result as used. Clients refer to outbounds by
+// name, so two of them must never share one.
+func uniqueName(used map[string]bool, name string) string {
+	unique := name
+	for n := 2; used[unique]; n++ {
+		unique = name + " " + strconv.Itoa(n)
+	}
+	used[unique] = true
+	return unique
+}
+
+// ssMethod is the host's shadowsocks cipher.
+func (h RawHost) ssMethod() string {
+	if h.ProtocolOptions != nil && h.ProtocolOptions.SS != nil && h.ProtocolOptions.SS.Method != nil {
+		return *h.ProtocolOptions.SS.Method
+	}
+	return defaultSSMethod
+}
+
+// fingerprint is the TLS client fingerprint to imitate for the host.
+func (h RawHost) fingerprint() string {
+	if h.Fingerprint != "" {
+		return h.Fingerprint
+	}
+	return defaultFingerprint
+}
@@ -0,0 +1,28 @@
+package remnawave
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestUniqueName(t *testing.T) {
+	tests := []struct {
+		names []string
+		want  []string
+	}{
+		{[]string{"NL", "DE"}, []string{"NL", "DE"}},
+		{[]string{"NL", "NL", "NL"}, []string{"NL", "NL 2", "NL 3"}},
+		{[]string{"NL", "NL 2", "NL"}, []string{"NL", "NL 2", "NL 3"}},
+		{[]string{"NL", "NL", "NL 2"}, []string{"NL", "NL 2", "NL 2 2"}},
+	}
+	for _, tt := range tests {
+		used := make(map[string]bool)
+		var got []string
+		for _, name := range tt.names {
+			got = append(got, uniqueName(used, name))
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("uniqueName over %q = %q, want %q", tt.names, got, tt.want)
+		}
+	}
+}
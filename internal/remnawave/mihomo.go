@@ -0,0 +1,169 @@
+package remnawave
+
+import (
+	"bytes"
+	"fmt"
+	"remnawave-json/internal/config"
+
+	"gopkg.in/yaml.v3"
+)
+
+type MihomoProxy struct {
+	Name              string          `yaml:"name"`
+	Type              string          `yaml:"type"`
+	Server            string          `yaml:"server"`
+	Port              int             `yaml:"port"`
+	UUID              string          `yaml:"uuid,omitempty"`
+	Flow              string          `yaml:"flow,omitempty"`
+	Password          string          `yaml:"password,omitempty"`
+	Cipher            string          `yaml:"cipher,omitempty"`
+	UDP               bool            `yaml:"udp"`
+	Network           string          `yaml:"network,omitempty"`
+	TLS               bool            `yaml:"tls,omitempty"`
+	ServerName        string          `yaml:"servername,omitempty"`
+	SNI               string          `yaml:"sni,omitempty"`
+	ALPN              []string        `yaml:"alpn,omitempty"`
+	SkipCertVerify    bool            `yaml:"skip-cert-verify,omitempty"`
+	ClientFingerprint string          `yaml:"client-fingerprint,omitempty"`
+	RealityOpts       *MihomoReality  `yaml:"reality-opts,omitempty"`
+	WSOpts            *MihomoWSOpts   `yaml:"ws-opts,omitempty"`
+	GRPCOpts          *MihomoGRPCOpts `yaml:"grpc-opts,omitempty"`
+}
+
+type MihomoReality struct {
+	PublicKey string `yaml:"public-key"`
+	ShortID   string `yaml:"short-id"`
+}
+
+type MihomoWSOpts struct {
+	Path             string            `yaml:"path,omitempty"`
+	Headers          map[string]string `yaml:"headers,omitempty"`
+	V2rayHTTPUpgrade bool              `yaml:"v2ray-http-upgrade,omitempty"`
+}
+
+type MihomoGRPCOpts struct {
+	GRPCServiceName string `yaml:"grpc-service-name"`
+}
+
+// mihomoSupport is what the Mihomo config can express.
+var mihomoSupport = hostSupport{networks: []string{"ws", "httpupgrade", "grpc"}}
+
+// ConvertToMihomoConfig renders the Mihomo template with a proxy per
+// convertible host. Proxies are named after host remarks, which the template's
+// proxy-groups reference through the proxy tags placeholder.
+func ConvertToMihomoConfig(wrapper *ResponseConverterWrapper) ([]byte, []SkippedHost, error) {
+	proxies, _, skipped, err := convertHosts(wrapper.Response.RawHosts, mihomoSupport, hostNaming{byRemark: true}, buildMihomoProxy)
+	if err != nil {
+		return nil, skipped, err
+	}
+
+	generatedProxies := make([]interface{}, 0, len(proxies))
+	generatedNames := make([]interface{}, 0, len(proxies))
+	for _, proxy := range proxies {
+		value, err := toYAMLValue(proxy)
+		if err != nil {
+			return nil, skipped, err
+		}
+		generatedProxies = append(generatedProxies, value)
+		generatedNames = append(generatedNames, proxy.Name)
+	}
+
+	template := config.GetMihomoTemplate()
+	if len(template) == 0 {
+		return nil, skipped, fmt.Errorf("mihomo template is not loaded")
+	}
+	var base map[string]interface{}
+	if err := yaml.Unmarshal(template, &base); err != nil {
+		return nil, skipped, fmt.Errorf("decoding mihomo template: %w", err)
+	}
+
+	result, err := fillTemplate(base, map[string][]interface{}{
+		proxyOutboundsPlaceholder: generatedProxies,
+		proxyTagsPlaceholder:      generatedNames,
+	}, proxyOutboundsPlaceholder, proxyTagsPlaceholder)
+	if err != nil {
+		return nil, skipped, fmt.Errorf("failed to render mihomo template: %w", err)
+	}
+
+	var output bytes.Buffer
+	encoder := yaml.NewEncoder(&output)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(result); err != nil {
+		return nil, skipped, fmt.Errorf("failed to marshal output YAML: %w", err)
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, skipped, fmt.Errorf("failed to marshal output YAML: %w", err)
+	}
+
+	return output.Bytes(), skipped, nil
+}
+
+// buildMihomoProxy builds the Mihomo proxy for a host mihomoSupport accepts.
+func buildMihomoProxy(host RawHost, name string) MihomoProxy {
+	proxy := MihomoProxy{
+		Name:   name,
+		Server: host.Address,
+		Port:   host.Port,
+		UDP:    true,
+	}
+
+	switch host.Protocol {
+	case "vless":
+		proxy.Type = "vless"
+		proxy.UUID = host.Password.VlessPassword
+		proxy.Flow = host.Flow
+	case "trojan":
+		proxy.Type = "trojan"
+		proxy.Password = host.Password.TrojanPassword
+	case "shadowsocks":
+		proxy.Type = "ss"
+		proxy.Cipher = host.ssMethod()
+		proxy.Password = host.Password.SSPassword
+		return proxy
+	}
+
+	switch host.Network {
+	case "ws", "httpupgrade":
+		proxy.Network = "ws"
+		proxy.WSOpts = &MihomoWSOpts{Path: host.Path, V2rayHTTPUpgrade: host.Network == "httpupgrade"}
+		if host.Host != "" {
+			proxy.WSOpts.Headers = map[string]string{"Host": host.Host}
+		}
+	case "grpc":
+		proxy.Network = "grpc"
+		proxy.GRPCOpts = &MihomoGRPCOpts{GRPCServiceName: host.Path}
+	default:
+		proxy.Network = "tcp"
+	}
+
+	switch host.TLS {
+	case "reality":
+		proxy.RealityOpts = &MihomoReality{PublicKey: host.PublicKey, ShortID: host.ShortID}
+		fallthrough
+	case "tls":
+		proxy.TLS = true
+		proxy.ClientFingerprint = host.fingerprint()
+		proxy.ALPN = splitALPN(host.ALPN)
+		proxy.SkipCertVerify = host.AllowInsecure
+		if proxy.Type == "trojan" {
+			proxy.SNI = host.SNI
+		} else {
+			proxy.ServerName = host.SNI
+		}
+	}
+
+	return proxy
+}
+
+func toYAMLValue(v interface{}) (interface{}, error) {
+	data, err := yaml.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("encoding generated value: %w", err)
+	}
+
+	var value interface{}
+	if err := yaml.Unmarshal(data, &value); err != nil {
+		return nil, fmt.Errorf("decoding generated value: %w", err)
+	}
+	return value, nil
+}
@@ -1,12 +1,11 @@
 package remnawave
 
 import (
-	"encoding/json"
 	"fmt"
-	"io"
-	"log/slog"
-	"net/http"
 	"remnawave-json/internal/config"
+	"remnawave-json/internal/useragent"
+	"remnawave-json/internal/userselect"
+	"strings"
 )
 
 type ResponseConverterWrapper struct {
@@ -132,44 +131,56 @@ type Headers struct {
 	HideSettings           string `json:"hide-settings"`
 }
 
-type XrayConfig struct {
-	DNS       DNS        `json:"dns"`
-	Inbounds  []Inbound  `json:"inbounds"`
-	Outbounds []Outbound `json:"outbounds"`
-	Remarks   string     `json:"remarks"`
-	Routing   Routing    `json:"routing"`
+type Outbound struct {
+	Protocol       string          `json:"protocol"`
+	Settings       interface{}     `json:"settings,omitempty"`
+	StreamSettings *StreamSettings `json:"streamSettings,omitempty"`
+	Tag            string          `json:"tag"`
 }
 
-type DNS struct {
-	QueryStrategy string        `json:"queryStrategy"`
-	Servers       []interface{} `json:"servers"`
+type StreamSettings struct {
+	Network             string               `json:"network"`
+	Security            string               `json:"security"`
+	RealitySettings     *RealitySettings     `json:"realitySettings,omitempty"`
+	TLSSettings         *TLSSettings         `json:"tlsSettings,omitempty"`
+	TCPSettings         interface{}          `json:"tcpSettings,omitempty"`
+	WSSettings          *WSSettings          `json:"wsSettings,omitempty"`
+	GRPCSettings        *GRPCSettings        `json:"grpcSettings,omitempty"`
+	HTTPUpgradeSettings *HTTPUpgradeSettings `json:"httpupgradeSettings,omitempty"`
+	XHTTPSettings       *XHTTPSettings       `json:"xhttpSettings,omitempty"`
 }
 
-type FreedomSettings struct{}
+type TCPHeader struct {
+	Type    string      `json:"type"`
+	Request *TCPRequest `json:"request,omitempty"`
+}
 
-type BlackholeSettings struct{}
+type TCPRequest struct {
+	Path    []string            `json:"path"`
+	Headers map[string][]string `json:"headers,omitempty"`
+}
 
-type Inbound struct {
-	Listen   string      `json:"listen"`
-	Port     int         `json:"port"`
-	Protocol string      `json:"protocol"`
-	Settings interface{} `json:"settings"`
-	Sniffing Sniffing    `json:"sniffing"`
-	Tag      string      `json:"tag"`
+type WSSettings struct {
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers,omitempty"`
 }
 
-type Outbound struct {
-	Protocol       string          `json:"protocol"`
-	Settings       interface{}     `json:"settings,omitempty"`
-	StreamSettings *StreamSettings `json:"streamSettings,omitempty"`
-	Tag            string          `json:"tag"`
+type GRPCSettings struct {
+	ServiceName string `json:"serviceName"`
+	Authority   string `json:"authority,omitempty"`
+	MultiMode   bool   `json:"multiMode"`
 }
 
-type StreamSettings struct {
-	Network         string          `json:"network"`
-	Security        string          `json:"security"`
-	RealitySettings RealitySettings `json:"realitySettings"`
-	TCPSettings     interface{}     `json:"tcpSettings"`
+type HTTPUpgradeSettings struct {
+	Path string `json:"path"`
+	Host string `json:"host,omitempty"`
+}
+
+type XHTTPSettings struct {
+	Path  string      `json:"path"`
+	Host  string      `json:"host,omitempty"`
+	Mode  string      `json:"mode"`
+	Extra interface{} `json:"extra,omitempty"`
 }
 
 type RealitySettings struct {
@@ -180,33 +191,43 @@ type RealitySettings struct {
 	Show        bool   `json:"show"`
 }
 
+type TLSSettings struct {
+	ServerName    string   `json:"serverName,omitempty"`
+	ALPN          []string `json:"alpn,omitempty"`
+	Fingerprint   string   `json:"fingerprint"`
+	AllowInsecure bool     `json:"allowInsecure"`
+}
+
 type VLESSSettings struct {
 	VNext []VNext `json:"vnext"`
 }
 
+type TrojanSettings struct {
+	Servers []TrojanServer `json:"servers"`
+}
+
+type TrojanServer struct {
+	Address  string `json:"address"`
+	Port     int    `json:"port"`
+	Password string `json:"password"`
+}
+
+type ShadowsocksSettings struct {
+	Servers []ShadowsocksServer `json:"servers"`
+}
+
+type ShadowsocksServer struct {
+	Address  string `json:"address"`
+	Port     int    `json:"port"`
+	Method   string `json:"method"`
+	Password string `json:"password"`
+}
+
 type VNext struct {
 	Address string      `json:"address"`
 	Port    int         `json:"port"`
 	Users   []UserToRaw `json:"users"`
 }
-type Routing struct {
-	DomainMatcher    string           `json:"domainMatcher"`
-	DomainStrategy   string           `json:"domainStrategy"`
-	Rules            []Rule           `json:"rules"`
-	Balancers        []Balancer       `json:"balancers"`
-	BurstObservatory BurstObservatory `json:"burstObservatory"`
-}
-
-type Rule struct {
-	Type        string   `json:"type"`
-	InboundTag  []string `json:"inboundTag,omitempty"`
-	OutboundTag string   `json:"outboundTag,omitempty"`
-	BalancerTag string   `json:"balancerTag,omitempty"`
-	Protocol    []string `json:"protocol,omitempty"`
-	Domain      []string `json:"domain,omitempty"`
-	IP          []string `json:"ip,omitempty"`
-	Port        string   `json:"port,omitempty"`
-}
 
 type Balancer struct {
 	Tag      string   `json:"tag"`
@@ -246,6 +267,19 @@ type UserRaw struct {
 	LastConnectedNode        *LastConnectedNode    `json:"lastConnectedNode"`
 	Happ                     Happ
 }
+
+// Selected describes the user for matching against selectors.
+func (u UserRaw) Selected() userselect.User {
+	selected := userselect.User{ShortUuid: u.ShortUUID, Username: u.Username}
+	if u.Tag != nil {
+		selected.Tag = *u.Tag
+	}
+	for _, squad := range u.ActiveInternalSquads {
+		selected.Squads = append(selected.Squads, squad.Name)
+	}
+	return selected
+}
+
 type ConvertedUserInfo struct {
 	DaysLeft            float64 `json:"daysLeft"`
 	TrafficLimit        string  `json:"trafficLimit"`
@@ -270,7 +304,22 @@ type Happ struct {
 }
 
 type Strategy struct {
-	Type string `json:"type"`
+	Type     string            `json:"type"`
+	Settings *StrategySettings `json:"settings,omitempty"`
+}
+
+type StrategySettings struct {
+	Expected  int            `json:"expected,omitempty"`
+	MaxRTT    string         `json:"maxRTT,omitempty"`
+	Tolerance float64        `json:"tolerance,omitempty"`
+	Baselines []string       `json:"baselines,omitempty"`
+	Costs     []StrategyCost `json:"costs,omitempty"`
+}
+
+type StrategyCost struct {
+	Regexp bool    `json:"regexp"`
+	Match  string  `json:"match"`
+	Value  float64 `json:"value"`
 }
 
 type Observatory struct {
@@ -292,11 +341,6 @@ type PingConfig struct {
 	Connectivity string `json:"connectivity"`
 	Sampling     int    `json:"sampling"`
 }
-type Sniffing struct {
-	DestOverride []string `json:"destOverride"`
-	Enabled      bool     `json:"enabled"`
-	RouteOnly    bool     `json:"routeOnly,omitempty"`
-}
 
 type UserToRaw struct {
 	Encryption string `json:"encryption"`
@@ -308,315 +352,277 @@ type ResponseWrapper struct {
 	Response SubscriptionResponse `json:"response"`
 }
 
-func GetSubscription(shortUuid string, header string) (*SubscriptionResponse, error) {
-	httpReq, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/api/sub/%s/info", config.GetRemnaweveURL(), shortUuid), nil)
-	if err != nil {
-		return nil, fmt.Errorf("creating request: %w", err)
-	}
-	httpReq.Header.Set("Content-Type", "application/json")
-	httpReq.Header.Set("User-Agent", header)
-
-	resp, err := config.GetHttpClient().Do(httpReq)
-	if err != nil {
-		return nil, fmt.Errorf("sending request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		slog.Error("error while getting subscription", slog.String("url", config.GetRemnaweveURL()+resp.Request.URL.String()))
-		return nil, fmt.Errorf("getting subscription status: %s", resp.Status)
-	}
-
-	response := &ResponseWrapper{}
-	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-		return nil, fmt.Errorf("decoding response body: %w", err)
-	}
+// SkippedHost describes a raw host that was left out of the generated config.
+type SkippedHost struct {
+	Index  int    `json:"index"`
+	Remark string `json:"remark"`
+	Reason string `json:"reason"`
+}
 
-	return &response.Response, nil
+// xraySupport is what the balancer config can express.
+var xraySupport = hostSupport{
+	networks:      []string{"ws", "grpc", "httpupgrade", "xhttp"},
+	tcpHTTPHeader: true,
+	ssTransports:  true,
 }
 
-func GetRawSubscription(shortUuid string, r *http.Request) (*ResponseConverterWrapper, error) {
-	url := fmt.Sprintf("%s/api/subscriptions/by-short-uuid/%s/raw", config.GetRemnaweveURL(), shortUuid)
-	slog.Info("Making request to raw subscription", "url", url, "shortUuid", shortUuid)
+// ConvertToXrayConfig renders the balancer config, leaving out hosts that use
+// features the client doesn't support.
+func ConvertToXrayConfig(wrapper *ResponseConverterWrapper, client useragent.Client) ([]byte, []SkippedHost, error) {
+	response := wrapper.Response
 
-	httpReq, err := http.NewRequest(http.MethodGet, url, nil)
+	support := xraySupport
+	support.client = &client
+	outbounds, remarks, skipped, err := convertHosts(response.RawHosts, support, hostNaming{}, buildOutbound)
 	if err != nil {
-		return nil, fmt.Errorf("creating request: %w", err)
+		return nil, skipped, err
 	}
-
-	httpReq.Header.Set("Content-Type", "application/json")
-	for k, v := range r.Header {
-		httpReq.Header.Set(k, v[0])
+	if remarks == "" {
+		remarks = "Сервер VPN"
 	}
 
-	token := config.GetRemnawaveToken()
-	if token != nil && token != "" {
-		httpReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	selector := make([]string, 0, len(outbounds))
+	for _, outbound := range outbounds {
+		selector = append(selector, outbound.Tag)
 	}
-
-	resp, err := config.GetHttpClient().Do(httpReq)
+	balancer, observatory, burstObservatory := buildBalancer(selector, configuredBalancer())
+
+	outputJSON, err := renderXrayTemplate(config.GetXrayTemplate(), xrayTemplateData{
+		Remarks:          remarks,
+		Outbounds:        outbounds,
+		Balancer:         balancer,
+		Observatory:      observatory,
+		BurstObservatory: burstObservatory,
+		Rules:            selectRules(config.GetRuleSets(), response.User),
+	})
 	if err != nil {
-		return nil, fmt.Errorf("sending request: %w", err)
+		return nil, skipped, fmt.Errorf("failed to render Xray template: %w", err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		slog.Error("error while getting subscription", slog.String("url", config.GetRemnaweveURL()+resp.Request.URL.String()))
-		return nil, fmt.Errorf("getting subscription status: %s", resp.Status)
-	}
+	return outputJSON, skipped, nil
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("reading response body: %w", err)
+// selectRules collects, in file order, the rules of every rule set that
+// applies to the user.
+func selectRules(ruleSets []config.RuleSet, user UserRaw) []interface{} {
+	selected := user.Selected()
+
+	var rules []interface{}
+	for _, ruleSet := range ruleSets {
+		if ruleSet.AppliesTo(selected) {
+			rules = append(rules, ruleSet.Rules...)
+		}
 	}
+	return rules
+}
 
-	fmt.Println(string(body))
+// balancerSettings are the BALANCER_* options the balancer is built with.
+type balancerSettings struct {
+	strategy      string
+	costs         []config.BalancerCost
+	probeURL      string
+	probeInterval string
+}
 
-	var wrapper ResponseConverterWrapper
-	if err := json.Unmarshal(body, &wrapper); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal JSON: %w", err)
+func configuredBalancer() balancerSettings {
+	return balancerSettings{
+		strategy:      config.GetBalancerStrategy(),
+		costs:         config.GetBalancerCosts(),
+		probeURL:      config.GetBalancerProbeURL(),
+		probeInterval: config.GetBalancerProbeInterval(),
 	}
-
-	return &wrapper, nil
 }
 
-func ConvertToXrayConfig(wrapper *ResponseConverterWrapper) ([]byte, error) {
-	response := wrapper.Response
+// buildBalancer returns the proxy-balancer over the selector tags and the
+// observatory its strategy relies on.
+func buildBalancer(selector []string, opts balancerSettings) (Balancer, *Observatory, *BurstObservatory) {
+	strategy := Strategy{Type: opts.strategy}
+	if strategy.Type == "leastLoad" {
+		settings := &StrategySettings{}
+		for _, cost := range opts.costs {
+			settings.Costs = append(settings.Costs, StrategyCost{Regexp: true, Match: cost.Match, Value: cost.Value})
+		}
+		strategy.Settings = settings
+	}
 
-	if len(response.RawHosts) == 0 {
-		return nil, fmt.Errorf("no raw hosts found in response")
+	balancer := Balancer{
+		Tag:      "proxy-balancer",
+		Selector: selector,
+		Strategy: strategy,
 	}
-	var remarks string
-	if response.RawHosts[0].Remark != "" {
-		remarks = response.RawHosts[0].Remark
-	} else {
-		remarks = "Сервер VPN"
+
+	if strategy.Type == "leastPing" {
+		return balancer, &Observatory{
+			SubjectSelector:   selector,
+			ProbeUrl:          opts.probeURL,
+			ProbeInterval:     opts.probeInterval,
+			EnableConcurrency: true,
+		}, nil
 	}
 
-	config := XrayConfig{
-		DNS: DNS{
-			QueryStrategy: "UseIPv4",
-			Servers: []interface{}{
-				"94.140.14.14",
-				map[string]interface{}{
-					"address": "94.140.14.14",
-					"domains": []string{"geosite:youtube", "geosite:category-ban-ru"},
-					"port":    53,
-				},
-				map[string]interface{}{
-					"address": "94.140.15.15",
-					"domains": []string{"geosite:private", "geosite:category-ru", "geosite:apple", "geosite:twitch"},
-					"port":    53,
-				},
-			},
+	return balancer, nil, &BurstObservatory{
+		SubjectSelector: selector,
+		PingConfig: PingConfig{
+			Interval:     opts.probeInterval,
+			Timeout:      "10s",
+			Destination:  opts.probeURL,
+			Connectivity: "",
+			Sampling:     3,
 		},
-		Inbounds: []Inbound{
-			{
-				Listen:   "127.0.0.1",
-				Port:     10808,
-				Protocol: "socks",
-				Settings: map[string]interface{}{
-					"auth": "noauth",
-					"udp":  true,
-				},
-				Sniffing: Sniffing{
-					DestOverride: []string{"http", "tls", "quic"},
-					Enabled:      true,
-					RouteOnly:    false,
-				},
-				Tag: "socks",
-			},
-			{
-				Listen:   "127.0.0.1",
-				Port:     10809,
-				Protocol: "http",
-				Settings: map[string]interface{}{
-					"allowTransparent": false,
-				},
-				Sniffing: Sniffing{
-					DestOverride: []string{"http", "tls", "quic"},
-					Enabled:      true,
-					RouteOnly:    false,
-				},
-				Tag: "http",
-			},
-		},
-		Remarks: remarks,
-		Routing: Routing{
-			DomainMatcher:  "hybrid",
-			DomainStrategy: "IPIfNonMatch",
-			Rules: []Rule{
-				{
-					Type: "field",
-					Domain: []string{
-						"geosite:private",
-						"geosite:category-ru",
-						"geosite:apple",
-						"geosite:twitch",
-					},
-					OutboundTag: "direct",
-				},
-				{
-					Type: "field",
-					IP: []string{
-						"geoip:ru",
-						"geoip:private",
-					},
-					OutboundTag: "direct",
-				},
-				{
-					Type: "field",
-					Domain: []string{
-						"geosite:youtube",
-						"geosite:category-ban-ru",
-					},
-					BalancerTag: "proxy-balancer",
-				},
-				{
-					Type: "field",
-					IP: []string{
-						"158.85.224.160/27",
-						"158.85.46.128/27",
-						"158.85.5.192/27",
-						"173.192.222.160/27",
-						"173.192.231.32/27",
-						"18.194.0.0/15",
-						"184.173.128.0/17",
-						"208.43.122.128/27",
-						"34.224.0.0/12",
-						"50.22.198.204/30",
-						"54.242.0.0/15",
-						"91.108.56.0/22",
-						"91.108.4.0/22",
-						"91.108.8.0/22",
-						"91.108.16.0/22",
-						"91.108.12.0/22",
-						"149.154.160.0/20",
-						"91.105.192.0/23",
-						"91.108.20.0/22",
-						"85.76.151.0/24",
-						"2001:b28:f23d::/48",
-						"2001:b28:f23f::/48",
-						"2001:67c:4e8::/48",
-						"2001:b28:f23c::/48",
-						"2a0a:f280::/32",
-					},
-					BalancerTag: "proxy-balancer",
-				},
-				{
-					Type: "field",
-					IP: []string{
-						"94.140.14.14",
-					},
-					Port:        "53",
-					BalancerTag: "proxy-balancer",
-				},
-				{
-					Type: "field",
-					IP: []string{
-						"94.140.15.15",
-					},
-					Port:        "53",
-					OutboundTag: "direct",
-				},
-				// Правило для socks-direct inbound
+	}
+}
+
+// buildOutbound builds the Xray outbound for a host xraySupport accepts.
+func buildOutbound(host RawHost, tag string) Outbound {
+	var settings interface{}
+	switch host.Protocol {
+	case "vless":
+		settings = VLESSSettings{
+			VNext: []VNext{
 				{
-					Type: "field",
-					InboundTag: []string{
-						"socks-direct",
+					Address: host.Address,
+					Port:    host.Port,
+					Users: []UserToRaw{
+						{
+							Encryption: "none",
+							Flow:       host.Flow,
+							ID:         host.Password.VlessPassword,
+						},
 					},
-					OutboundTag: "direct",
-				},
-				{
-					Type:        "field",
-					InboundTag:  []string{"socks", "http"},
-					BalancerTag: "proxy-balancer",
 				},
 			},
-			Balancers: []Balancer{
+		}
+	case "trojan":
+		settings = TrojanSettings{
+			Servers: []TrojanServer{
 				{
-					Tag:      "proxy-balancer",
-					Selector: []string{"proxy1", "proxy2", "proxy3"},
-					Strategy: Strategy{Type: "roundRobin"},
+					Address:  host.Address,
+					Port:     host.Port,
+					Password: host.Password.TrojanPassword,
 				},
 			},
-			BurstObservatory: BurstObservatory{
-				SubjectSelector: []string{"proxy"},
-				PingConfig: PingConfig{
-					Interval:     "5m",
-					Timeout:      "10s",
-					Destination:  "https://connectivitycheck.gstatic.com/generate_204",
-					Connectivity: "",
-					Sampling:     3,
+		}
+	case "shadowsocks":
+		settings = ShadowsocksSettings{
+			Servers: []ShadowsocksServer{
+				{
+					Address:  host.Address,
+					Port:     host.Port,
+					Method:   host.ssMethod(),
+					Password: host.Password.SSPassword,
 				},
 			},
-		},
+		}
 	}
 
-	hostsToProcess := len(response.RawHosts)
+	return Outbound{
+		Protocol:       host.Protocol,
+		Settings:       settings,
+		StreamSettings: buildStreamSettings(host),
+		Tag:            tag,
+	}
+}
 
-	for i := 0; i < hostsToProcess; i++ {
-		host := response.RawHosts[i]
+func buildStreamSettings(host RawHost) *StreamSettings {
+	streamSettings := &StreamSettings{}
 
-		if host.Protocol != "vless" {
-			return nil, fmt.Errorf("host %d must use vless protocol", i+1)
+	switch host.Network {
+	case "tcp", "raw":
+		streamSettings.Network = "tcp"
+		streamSettings.TCPSettings = buildTCPSettings(host)
+	case "ws":
+		streamSettings.Network = "ws"
+		streamSettings.WSSettings = &WSSettings{Path: host.Path}
+		if host.Host != "" {
+			streamSettings.WSSettings.Headers = map[string]string{"Host": host.Host}
 		}
-		if host.TLS != "reality" {
-			return nil, fmt.Errorf("host %d must use reality TLS", i+1)
+	case "grpc":
+		streamSettings.Network = "grpc"
+		streamSettings.GRPCSettings = &GRPCSettings{
+			ServiceName: host.Path,
+			Authority:   host.Host,
+			MultiMode:   transportMode(host) == "multi",
 		}
-		if host.Network != "tcp" {
-			return nil, fmt.Errorf("host %d must use tcp network", i+1)
+	case "httpupgrade":
+		streamSettings.Network = "httpupgrade"
+		streamSettings.HTTPUpgradeSettings = &HTTPUpgradeSettings{
+			Path: host.Path,
+			Host: host.Host,
 		}
-
-		fingerprint := "chrome"
-		if host.Fingerprint != "" {
-			fingerprint = host.Fingerprint
+	case "xhttp":
+		mode := transportMode(host)
+		if mode == "" {
+			mode = "auto"
+		}
+		streamSettings.Network = "xhttp"
+		streamSettings.XHTTPSettings = &XHTTPSettings{
+			Path: host.Path,
+			Host: host.Host,
+			Mode: mode,
 		}
+		if host.XHttpExtraParams != nil {
+			streamSettings.XHTTPSettings.Extra = *host.XHttpExtraParams
+		}
+	}
 
-		outbound := Outbound{
-			Protocol: "vless",
-			Settings: VLESSSettings{
-				VNext: []VNext{
-					{
-						Address: host.Address,
-						Port:    host.Port,
-						Users: []UserToRaw{
-							{
-								Encryption: "none",
-								Flow:       host.Flow,
-								ID:         host.Password.VlessPassword,
-							},
-						},
-					},
-				},
-			},
-			StreamSettings: &StreamSettings{
-				Network:  "tcp",
-				Security: "reality",
-				RealitySettings: RealitySettings{
-					Fingerprint: fingerprint,
-					PublicKey:   host.PublicKey,
-					ServerName:  host.SNI,
-					ShortID:     host.ShortID,
-					Show:        false,
-				},
-				TCPSettings: map[string]interface{}{},
-			},
-			Tag: fmt.Sprintf("proxy%d", i+1),
+	switch host.TLS {
+	case "reality":
+		streamSettings.Security = "reality"
+		streamSettings.RealitySettings = &RealitySettings{
+			Fingerprint: host.fingerprint(),
+			PublicKey:   host.PublicKey,
+			ServerName:  host.SNI,
+			ShortID:     host.ShortID,
+			Show:        false,
 		}
-		config.Outbounds = append(config.Outbounds, outbound)
+	case "tls":
+		streamSettings.Security = "tls"
+		streamSettings.TLSSettings = &TLSSettings{
+			ServerName:    host.SNI,
+			ALPN:          splitALPN(host.ALPN),
+			Fingerprint:   host.fingerprint(),
+			AllowInsecure: host.AllowInsecure,
+		}
+	default:
+		streamSettings.Security = "none"
 	}
 
-	config.Outbounds = append(config.Outbounds,
-		Outbound{Protocol: "freedom", Tag: "direct", Settings: FreedomSettings{}},
-		Outbound{Protocol: "blackhole", Tag: "block", Settings: BlackholeSettings{}},
-		Outbound{Protocol: "blackhole", Tag: "TORRENT", Settings: BlackholeSettings{}},
-	)
+	return streamSettings
+}
+
+func buildTCPSettings(host RawHost) interface{} {
+	if host.HeaderType == nil || *host.HeaderType != "http" {
+		return map[string]interface{}{}
+	}
 
-	outputJSON, err := json.MarshalIndent(config, "", "  ")
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal output JSON: %w", err)
+	path := host.Path
+	if path == "" {
+		path = "/"
+	}
+	request := &TCPRequest{Path: []string{path}}
+	if host.Host != "" {
+		request.Headers = map[string][]string{"Host": {host.Host}}
 	}
 
-	return outputJSON, nil
+	return map[string]interface{}{
+		"header": TCPHeader{Type: "http", Request: request},
+	}
+}
+
+func transportMode(host RawHost) string {
+	if host.AdditionalParams == nil || host.AdditionalParams.Mode == nil {
+		return ""
+	}
+	return *host.AdditionalParams.Mode
+}
+
+func splitALPN(alpn string) []string {
+	var values []string
+	for _, v := range strings.Split(alpn, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
 }
@@ -0,0 +1,364 @@
+package remnawave
+
+import (
+	"encoding/json"
+	"errors"
+	"maps"
+	"remnawave-json/internal/config"
+	"remnawave-json/internal/useragent"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// outboundJSON builds the host's outbound and decodes it generically, as the
+// template sees it.
+func outboundJSON(t *testing.T, host RawHost) map[string]interface{} {
+	t.Helper()
+	data, err := json.Marshal(buildOutbound(host, "proxy1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var outbound map[string]interface{}
+	if err := json.Unmarshal(data, &outbound); err != nil {
+		t.Fatal(err)
+	}
+	return outbound
+}
+
+// field walks a decoded JSON value along keys and array indexes.
+func field(v interface{}, path ...interface{}) interface{} {
+	for _, step := range path {
+		switch s := step.(type) {
+		case string:
+			obj, ok := v.(map[string]interface{})
+			if !ok {
+				return nil
+			}
+			v = obj[s]
+		case int:
+			arr, ok := v.([]interface{})
+			if !ok || s >= len(arr) {
+				return nil
+			}
+			v = arr[s]
+		}
+	}
+	return v
+}
+
+func TestBuildOutboundMatrix(t *testing.T) {
+	protocols := map[string]RawHost{
+		"vless":       {Protocol: "vless", Flow: "xtls-rprx-vision", Password: Passwords{VlessPassword: "uuid"}},
+		"trojan":      {Protocol: "trojan", Password: Passwords{TrojanPassword: "secret"}},
+		"shadowsocks": {Protocol: "shadowsocks", Password: Passwords{SSPassword: "pass"}},
+	}
+	networks := map[string]string{
+		"tcp":         "tcpSettings",
+		"ws":          "wsSettings",
+		"grpc":        "grpcSettings",
+		"httpupgrade": "httpupgradeSettings",
+		"xhttp":       "xhttpSettings",
+	}
+	securities := map[string]string{
+		"reality": "realitySettings",
+		"tls":     "tlsSettings",
+		"none":    "",
+	}
+
+	for protocol, base := range protocols {
+		for network, settingsKey := range networks {
+			for security, securityKey := range securities {
+				host := base
+				host.Network, host.TLS = network, security
+				host.Address, host.Port = "nl.example.com", 443
+				if err := xraySupport.check(host); err != nil {
+					t.Errorf("%s/%s/%s rejected: %v", protocol, network, security, err)
+					continue
+				}
+
+				outbound := outboundJSON(t, host)
+				name := protocol + "/" + network + "/" + security
+				if outbound["protocol"] != protocol || outbound["tag"] != "proxy1" {
+					t.Errorf("%s: protocol %v, tag %v", name, outbound["protocol"], outbound["tag"])
+				}
+
+				switch protocol {
+				case "vless":
+					server := field(outbound, "settings", "vnext", 0)
+					if field(server, "address") != "nl.example.com" || field(server, "port") != 443.0 ||
+						field(server, "users", 0, "id") != "uuid" || field(server, "users", 0, "flow") != "xtls-rprx-vision" ||
+						field(server, "users", 0, "encryption") != "none" {
+						t.Errorf("%s: vless settings %v", name, outbound["settings"])
+					}
+				case "trojan":
+					server := field(outbound, "settings", "servers", 0)
+					if field(server, "address") != "nl.example.com" || field(server, "port") != 443.0 || field(server, "password") != "secret" {
+						t.Errorf("%s: trojan settings %v", name, outbound["settings"])
+					}
+				case "shadowsocks":
+					server := field(outbound, "settings", "servers", 0)
+					if field(server, "password") != "pass" || field(server, "method") != defaultSSMethod {
+						t.Errorf("%s: shadowsocks settings %v", name, outbound["settings"])
+					}
+				}
+
+				stream := field(outbound, "streamSettings")
+				if field(stream, "network") != network || field(stream, "security") != security {
+					t.Errorf("%s: stream %v", name, stream)
+				}
+				if field(stream, settingsKey) == nil {
+					t.Errorf("%s: stream has no %s: %v", name, settingsKey, stream)
+				}
+				for _, key := range []string{"realitySettings", "tlsSettings"} {
+					if present := field(stream, key) != nil; present != (key == securityKey) {
+						t.Errorf("%s: %s present = %v", name, key, present)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestBuildOutboundShadowsocksMethod(t *testing.T) {
+	method := "2022-blake3-aes-128-gcm"
+	host := RawHost{Protocol: "shadowsocks", Network: "tcp", ProtocolOptions: &ProtocolOptions{SS: &SSOptions{Method: &method}}}
+	if got := field(outboundJSON(t, host), "settings", "servers", 0, "method"); got != method {
+		t.Errorf("method = %v, want %s", got, method)
+	}
+}
+
+func TestBuildStreamSettingsTransports(t *testing.T) {
+	httpHeader := "http"
+	multi := "multi"
+	packetUp := "packet-up"
+	var extra interface{} = map[string]interface{}{"xPaddingBytes": "100-1000"}
+
+	tests := []struct {
+		name string
+		host RawHost
+		want string
+	}{
+		{"tcp", RawHost{Network: "tcp"}, `{"network":"tcp","security":"none","tcpSettings":{}}`},
+		{"raw is tcp", RawHost{Network: "raw"}, `{"network":"tcp","security":"none","tcpSettings":{}}`},
+		{"tcp http header", RawHost{Network: "tcp", HeaderType: &httpHeader, Host: "example.com"},
+			`{"network":"tcp","security":"none","tcpSettings":{"header":{"type":"http","request":{"path":["/"],"headers":{"Host":["example.com"]}}}}}`},
+		{"ws", RawHost{Network: "ws", Path: "/ws", Host: "cdn.example.com"},
+			`{"network":"ws","security":"none","wsSettings":{"path":"/ws","headers":{"Host":"cdn.example.com"}}}`},
+		{"ws without host", RawHost{Network: "ws", Path: "/ws"}, `{"network":"ws","security":"none","wsSettings":{"path":"/ws"}}`},
+		{"grpc", RawHost{Network: "grpc", Path: "svc", Host: "example.com"},
+			`{"network":"grpc","security":"none","grpcSettings":{"serviceName":"svc","authority":"example.com","multiMode":false}}`},
+		{"grpc multi", RawHost{Network: "grpc", Path: "svc", AdditionalParams: &AdditionalParams{Mode: &multi}},
+			`{"network":"grpc","security":"none","grpcSettings":{"serviceName":"svc","multiMode":true}}`},
+		{"httpupgrade", RawHost{Network: "httpupgrade", Path: "/up", Host: "example.com"},
+			`{"network":"httpupgrade","security":"none","httpupgradeSettings":{"path":"/up","host":"example.com"}}`},
+		{"xhttp defaults to auto", RawHost{Network: "xhttp", Path: "/x"},
+			`{"network":"xhttp","security":"none","xhttpSettings":{"path":"/x","mode":"auto"}}`},
+		{"xhttp mode and extra", RawHost{Network: "xhttp", Path: "/x", Host: "example.com", AdditionalParams: &AdditionalParams{Mode: &packetUp}, XHttpExtraParams: &extra},
+			`{"network":"xhttp","security":"none","xhttpSettings":{"path":"/x","host":"example.com","mode":"packet-up","extra":{"xPaddingBytes":"100-1000"}}}`},
+	}
+	for _, tt := range tests {
+		data, err := json.Marshal(buildStreamSettings(tt.host))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != tt.want {
+			t.Errorf("%s: stream settings =\n%s\nwant\n%s", tt.name, data, tt.want)
+		}
+	}
+}
+
+func TestBuildStreamSettingsSecurity(t *testing.T) {
+	tests := []struct {
+		name string
+		host RawHost
+		want string
+	}{
+		{"reality", RawHost{Network: "tcp", TLS: "reality", PublicKey: "pbk", ShortID: "sid", SNI: "www.example.com"},
+			`{"network":"tcp","security":"reality","realitySettings":{"fingerprint":"chrome","publicKey":"pbk","serverName":"www.example.com","shortId":"sid","show":false},"tcpSettings":{}}`},
+		{"reality fingerprint", RawHost{Network: "tcp", TLS: "reality", Fingerprint: "safari", PublicKey: "pbk"},
+			`{"network":"tcp","security":"reality","realitySettings":{"fingerprint":"safari","publicKey":"pbk","serverName":"","shortId":"","show":false},"tcpSettings":{}}`},
+		{"tls", RawHost{Network: "ws", Path: "/", TLS: "tls", SNI: "example.com", ALPN: "h2, http/1.1,", AllowInsecure: true},
+			`{"network":"ws","security":"tls","tlsSettings":{"serverName":"example.com","alpn":["h2","http/1.1"],"fingerprint":"chrome","allowInsecure":true},"wsSettings":{"path":"/"}}`},
+		{"tls without sni or alpn", RawHost{Network: "grpc", Path: "svc", TLS: "tls", Fingerprint: "firefox"},
+			`{"network":"grpc","security":"tls","tlsSettings":{"fingerprint":"firefox","allowInsecure":false},"grpcSettings":{"serviceName":"svc","multiMode":false}}`},
+		{"none", RawHost{Network: "tcp", TLS: "none"}, `{"network":"tcp","security":"none","tcpSettings":{}}`},
+		{"empty is none", RawHost{Network: "tcp"}, `{"network":"tcp","security":"none","tcpSettings":{}}`},
+	}
+	for _, tt := range tests {
+		data, err := json.Marshal(buildStreamSettings(tt.host))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != tt.want {
+			t.Errorf("%s: stream settings =\n%s\nwant\n%s", tt.name, data, tt.want)
+		}
+	}
+}
+
+func TestConvertHostsSkipsForXray(t *testing.T) {
+	httpHeader := "http"
+	hosts := []RawHost{
+		{Remark: "ok", Protocol: "vless", Network: "tcp", TLS: "reality"},
+		{Remark: "hidden", Protocol: "vless", Network: "tcp", DbData: DbData{IsHidden: true}},
+		{Remark: "disabled", Protocol: "trojan", Network: "ws", DbData: DbData{IsDisabled: true}},
+		{Remark: "vmess", Protocol: "vmess", Network: "tcp"},
+		{Remark: "kcp", Protocol: "vless", Network: "kcp"},
+		{Remark: "xtls", Protocol: "vless", Network: "tcp", TLS: "xtls"},
+		{Remark: "xhttp", Protocol: "vless", Network: "xhttp", TLS: "reality"},
+		{Remark: "http header", Protocol: "trojan", Network: "tcp", HeaderType: &httpHeader},
+		{Remark: "ss over ws", Protocol: "shadowsocks", Network: "ws"},
+	}
+	reasons := map[string]string{
+		"hidden":   "hidden or disabled",
+		"disabled": "hidden or disabled",
+		"vmess":    "unsupported protocol vmess",
+		"kcp":      "unsupported network kcp",
+		"xtls":     "unsupported security xtls",
+	}
+
+	tests := []struct {
+		userAgent string
+		xhttp     bool
+	}{
+		{"Happ/1.9.2/ios", true},
+		{"Happ/1.6.0/ios", false},
+		{"v2rayNG/1.9.16", true},
+	}
+	for _, tt := range tests {
+		client := useragent.Parse(tt.userAgent)
+		support := xraySupport
+		support.client = &client
+
+		outbounds, remarks, skipped, err := convertHosts(hosts, support, hostNaming{}, buildOutbound)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.userAgent, err)
+		}
+		if remarks != "ok" {
+			t.Errorf("%s: remarks = %q, want ok", tt.userAgent, remarks)
+		}
+
+		want := maps.Clone(reasons)
+		wantOutbounds := 4
+		if !tt.xhttp {
+			want["xhttp"] = "client does not support xhttp"
+			wantOutbounds = 3
+		}
+		got := make(map[string]string)
+		for _, host := range skipped {
+			got[host.Remark] = host.Reason
+			if hosts[host.Index-1].Remark != host.Remark {
+				t.Errorf("%s: skipped index %d is not %q", tt.userAgent, host.Index, host.Remark)
+			}
+		}
+		if !maps.Equal(got, want) {
+			t.Errorf("%s: skipped = %v, want %v", tt.userAgent, got, want)
+		}
+		if len(outbounds) != wantOutbounds {
+			t.Errorf("%s: outbounds = %d, want %d", tt.userAgent, len(outbounds), wantOutbounds)
+		}
+		for i, outbound := range outbounds {
+			if want := "proxy" + strconv.Itoa(i+1); outbound.Tag != want {
+				t.Errorf("%s: outbound %d tag = %q, want %q", tt.userAgent, i, outbound.Tag, want)
+			}
+		}
+	}
+}
+
+func TestConvertHostsErrors(t *testing.T) {
+	if _, _, _, err := convertHosts(nil, xraySupport, hostNaming{}, buildOutbound); !errors.Is(err, errNoHosts) {
+		t.Errorf("no hosts: err = %v", err)
+	}
+	hosts := []RawHost{{Remark: "hidden", Protocol: "vless", Network: "tcp", DbData: DbData{IsHidden: true}}}
+	_, _, skipped, err := convertHosts(hosts, xraySupport, hostNaming{}, buildOutbound)
+	if !errors.Is(err, errNoConvertibleHosts) || len(skipped) != 1 {
+		t.Errorf("nothing convertible: err = %v, skipped = %v", err, skipped)
+	}
+}
+
+func TestBuildBalancer(t *testing.T) {
+	selector := []string{"proxy1", "proxy2"}
+	costs := []config.BalancerCost{{Match: "proxy1", Value: 0.5}, {Match: "proxy[2-3]", Value: 2}}
+
+	tests := []struct {
+		strategy         string
+		balancer         string
+		observatory      string
+		burstObservatory string
+	}{
+		{
+			strategy:    "leastPing",
+			balancer:    `{"tag":"proxy-balancer","selector":["proxy1","proxy2"],"strategy":{"type":"leastPing"}}`,
+			observatory: `{"subjectSelector":["proxy1","proxy2"],"probeUrl":"https://example.com/204","probeInterval":"1m","enableConcurrency":true}`,
+		},
+		{
+			strategy:         "leastLoad",
+			balancer:         `{"tag":"proxy-balancer","selector":["proxy1","proxy2"],"strategy":{"type":"leastLoad","settings":{"costs":[{"regexp":true,"match":"proxy1","value":0.5},{"regexp":true,"match":"proxy[2-3]","value":2}]}}}`,
+			burstObservatory: `{"subjectSelector":["proxy1","proxy2"],"pingConfig":{"interval":"1m","timeout":"10s","destination":"https://example.com/204","connectivity":"","sampling":3}}`,
+		},
+		{
+			strategy:         "roundRobin",
+			balancer:         `{"tag":"proxy-balancer","selector":["proxy1","proxy2"],"strategy":{"type":"roundRobin"}}`,
+			burstObservatory: `{"subjectSelector":["proxy1","proxy2"],"pingConfig":{"interval":"1m","timeout":"10s","destination":"https://example.com/204","connectivity":"","sampling":3}}`,
+		},
+	}
+	for _, tt := range tests {
+		balancer, observatory, burstObservatory := buildBalancer(selector, balancerSettings{
+			strategy:      tt.strategy,
+			costs:         costs,
+			probeURL:      "https://example.com/204",
+			probeInterval: "1m",
+		})
+
+		for name, got := range map[string]struct {
+			value interface{}
+			want  string
+		}{
+			"balancer":         {balancer, tt.balancer},
+			"observatory":      {observatory, tt.observatory},
+			"burstObservatory": {burstObservatory, tt.burstObservatory},
+		} {
+			data, err := json.Marshal(got.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := got.want
+			if want == "" {
+				want = "null"
+			}
+			if string(data) != want {
+				t.Errorf("%s: %s =\n%s\nwant\n%s", tt.strategy, name, data, want)
+			}
+		}
+	}
+}
+
+func TestSelectRules(t *testing.T) {
+	rule := func(name string) interface{} { return map[string]interface{}{"outboundTag": name} }
+	ruleSets := []config.RuleSet{
+		{Name: "common", Enabled: true, Rules: []interface{}{rule("common-1"), rule("common-2")}},
+		{Name: "off", Rules: []interface{}{rule("off")}},
+		{Name: "kz", Enabled: true, Squads: []string{"Kazakhstan"}, Rules: []interface{}{rule("kz")}},
+		{Name: "not-vip", Enabled: true, ExcludeTags: []string{"VIP"}, Rules: []interface{}{rule("not-vip")}},
+	}
+
+	vip := "VIP"
+	tests := []struct {
+		name string
+		user UserRaw
+		want []string
+	}{
+		{"no tag or squad", UserRaw{}, []string{"common-1", "common-2", "not-vip"}},
+		{"squad", UserRaw{ActiveInternalSquads: []ActiveInternalSquad{{Name: "Kazakhstan"}}}, []string{"common-1", "common-2", "kz", "not-vip"}},
+		{"excluded tag", UserRaw{Tag: &vip, ActiveInternalSquads: []ActiveInternalSquad{{Name: "Kazakhstan"}}}, []string{"common-1", "common-2", "kz"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, r := range selectRules(ruleSets, tt.user) {
+			got = append(got, field(r, "outboundTag").(string))
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: selectRules() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package remnawave
+
+import (
+	"encoding/json"
+	"fmt"
+	"remnawave-json/internal/config"
+)
+
+type SingBoxOutbound struct {
+	Type           string            `json:"type"`
+	Tag            string            `json:"tag"`
+	Server         string            `json:"server"`
+	ServerPort     int               `json:"server_port"`
+	UUID           string            `json:"uuid,omitempty"`
+	Flow           string            `json:"flow,omitempty"`
+	PacketEncoding string            `json:"packet_encoding,omitempty"`
+	Method         string            `json:"method,omitempty"`
+	Password       string            `json:"password,omitempty"`
+	TLS            *SingBoxTLS       `json:"tls,omitempty"`
+	Transport      *SingBoxTransport `json:"transport,omitempty"`
+}
+
+type SingBoxTLS struct {
+	Enabled    bool            `json:"enabled"`
+	ServerName string          `json:"server_name,omitempty"`
+	Insecure   bool            `json:"insecure,omitempty"`
+	ALPN       []string        `json:"alpn,omitempty"`
+	UTLS       *SingBoxUTLS    `json:"utls,omitempty"`
+	Reality    *SingBoxReality `json:"reality,omitempty"`
+}
+
+type SingBoxUTLS struct {
+	Enabled     bool   `json:"enabled"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+type SingBoxReality struct {
+	Enabled   bool   `json:"enabled"`
+	PublicKey string `json:"public_key"`
+	ShortID   string `json:"short_id"`
+}
+
+type SingBoxTransport struct {
+	Type        string            `json:"type"`
+	Path        string            `json:"path,omitempty"`
+	Host        string            `json:"host,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	ServiceName string            `json:"service_name,omitempty"`
+}
+
+// singBoxSupport is what the sing-box config can express.
+var singBoxSupport = hostSupport{networks: []string{"ws", "grpc", "httpupgrade"}}
+
+// ConvertToSingBoxConfig renders the sing-box template with an outbound per
+// convertible host and every generated tag behind the urltest selector.
+// Outbounds are tagged with host remarks, which sing-box clients show.
+func ConvertToSingBoxConfig(wrapper *ResponseConverterWrapper) ([]byte, []SkippedHost, error) {
+	return convertToSingBoxConfig(wrapper, config.GetSingBoxTemplate())
+}
+
+func convertToSingBoxConfig(wrapper *ResponseConverterWrapper, template []byte) ([]byte, []SkippedHost, error) {
+	base, err := decodeTemplate(template)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to render sing-box template: %w", err)
+	}
+
+	naming := hostNaming{byRemark: true, reserved: templateTags(base)}
+	outbounds, _, skipped, err := convertHosts(wrapper.Response.RawHosts, singBoxSupport, naming, buildSingBoxOutbound)
+	if err != nil {
+		return nil, skipped, err
+	}
+
+	tags := make([]string, 0, len(outbounds))
+	for _, outbound := range outbounds {
+		tags = append(tags, outbound.Tag)
+	}
+
+	generatedOutbounds, err := toJSONValues(outbounds)
+	if err != nil {
+		return nil, skipped, err
+	}
+	generatedTags, err := toJSONValues(tags)
+	if err != nil {
+		return nil, skipped, err
+	}
+
+	result, err := fillTemplate(base, map[string][]interface{}{
+		proxyOutboundsPlaceholder: generatedOutbounds,
+		proxyTagsPlaceholder:      generatedTags,
+	}, proxyOutboundsPlaceholder, proxyTagsPlaceholder)
+	if err != nil {
+		return nil, skipped, fmt.Errorf("failed to render sing-box template: %w", err)
+	}
+
+	outputJSON, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return nil, skipped, fmt.Errorf("failed to marshal output JSON: %w", err)
+	}
+
+	return outputJSON, skipped, nil
+}
+
+// buildSingBoxOutbound builds the sing-box outbound for a host singBoxSupport
+// accepts.
+func buildSingBoxOutbound(host RawHost, tag string) SingBoxOutbound {
+	outbound := SingBoxOutbound{
+		Tag:        tag,
+		Server:     host.Address,
+		ServerPort: host.Port,
+	}
+
+	switch host.Protocol {
+	case "vless":
+		outbound.Type = "vless"
+		outbound.UUID = host.Password.VlessPassword
+		outbound.Flow = host.Flow
+		outbound.PacketEncoding = "xudp"
+	case "trojan":
+		outbound.Type = "trojan"
+		outbound.Password = host.Password.TrojanPassword
+	case "shadowsocks":
+		outbound.Type = "shadowsocks"
+		outbound.Method = host.ssMethod()
+		outbound.Password = host.Password.SSPassword
+		return outbound
+	}
+
+	outbound.Transport = buildSingBoxTransport(host)
+	outbound.TLS = buildSingBoxTLS(host)
+	return outbound
+}
+
+func buildSingBoxTransport(host RawHost) *SingBoxTransport {
+	switch host.Network {
+	case "ws":
+		transport := &SingBoxTransport{Type: "ws", Path: host.Path}
+		if host.Host != "" {
+			transport.Headers = map[string]string{"Host": host.Host}
+		}
+		return transport
+	case "grpc":
+		return &SingBoxTransport{Type: "grpc", ServiceName: host.Path}
+	case "httpupgrade":
+		return &SingBoxTransport{Type: "httpupgrade", Path: host.Path, Host: host.Host}
+	default:
+		return nil
+	}
+}
+
+func buildSingBoxTLS(host RawHost) *SingBoxTLS {
+	switch host.TLS {
+	case "reality":
+		return &SingBoxTLS{
+			Enabled:    true,
+			ServerName: host.SNI,
+			UTLS:       &SingBoxUTLS{Enabled: true, Fingerprint: host.fingerprint()},
+			Reality: &SingBoxReality{
+				Enabled:   true,
+				PublicKey: host.PublicKey,
+				ShortID:   host.ShortID,
+			},
+		}
+	case "tls":
+		return &SingBoxTLS{
+			Enabled:    true,
+			ServerName: host.SNI,
+			Insecure:   host.AllowInsecure,
+			ALPN:       splitALPN(host.ALPN),
+			UTLS:       &SingBoxUTLS{Enabled: true, Fingerprint: host.fingerprint()},
+		}
+	default:
+		return nil
+	}
+}
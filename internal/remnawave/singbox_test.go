@@ -0,0 +1,84 @@
+package remnawave
+
+import (
+	"encoding/json"
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestConvertToSingBoxConfig(t *testing.T) {
+	template, err := os.ReadFile("../../templates/sing-box/default.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vless := func(remark string) RawHost {
+		return RawHost{Remark: remark, Protocol: "vless", Network: "tcp", TLS: "reality", Address: "nl.example.com", Port: 443, PublicKey: "pbk", ShortID: "sid", SNI: "www.example.com", Password: Passwords{VlessPassword: "uuid"}}
+	}
+	wrapper := &ResponseConverterWrapper{Response: XrayConverterResponse{RawHosts: []RawHost{
+		vless("🇳🇱 Netherlands"),
+		vless("🇳🇱 Netherlands"),
+		{Remark: "hidden", Protocol: "vless", Network: "tcp", DbData: DbData{IsHidden: true}},
+		vless(""),
+		vless("direct"),
+		{Remark: "xhttp", Protocol: "vless", Network: "xhttp"},
+		{Remark: "🇩🇪 Germany", Protocol: "trojan", Network: "ws", TLS: "tls", Address: "de.example.com", Port: 443, Path: "/ws", Host: "cdn.example.com", SNI: "de.example.com", ALPN: "h2, http/1.1", Password: Passwords{TrojanPassword: "secret"}},
+		{Remark: "ss", Protocol: "shadowsocks", Network: "tcp", Address: "ss.example.com", Port: 8388, Password: Passwords{SSPassword: "pass"}},
+	}}}
+
+	output, skipped, err := convertToSingBoxConfig(wrapper, template)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var config struct {
+		Outbounds []struct {
+			SingBoxOutbound
+			Outbounds []string `json:"outbounds"`
+		} `json:"outbounds"`
+	}
+	if err := json.Unmarshal(output, &config); err != nil {
+		t.Fatal(err)
+	}
+
+	wantTags := []string{"🇳🇱 Netherlands", "🇳🇱 Netherlands 2", "proxy3", "direct 2", "🇩🇪 Germany", "ss"}
+	var urltest []string
+	generated := map[string]SingBoxOutbound{}
+	for _, outbound := range config.Outbounds {
+		switch outbound.Type {
+		case "urltest":
+			urltest = outbound.Outbounds
+		case "vless", "trojan", "shadowsocks":
+			generated[outbound.Tag] = outbound.SingBoxOutbound
+		}
+	}
+	if !slices.Equal(urltest, wantTags) {
+		t.Errorf("urltest outbounds = %q, want %q", urltest, wantTags)
+	}
+	if len(generated) != len(wantTags) {
+		t.Errorf("generated outbounds = %d, want %d", len(generated), len(wantTags))
+	}
+
+	nl := generated["🇳🇱 Netherlands"]
+	if nl.UUID != "uuid" || nl.Flow != "" || nl.PacketEncoding != "xudp" || nl.Transport != nil ||
+		nl.TLS == nil || nl.TLS.Reality == nil || nl.TLS.Reality.PublicKey != "pbk" || nl.TLS.UTLS.Fingerprint != defaultFingerprint {
+		t.Errorf("vless reality outbound = %+v", nl)
+	}
+	de := generated["🇩🇪 Germany"]
+	if de.Password != "secret" || de.Transport == nil || de.Transport.Type != "ws" || de.Transport.Headers["Host"] != "cdn.example.com" ||
+		de.TLS == nil || de.TLS.Reality != nil || !slices.Equal(de.TLS.ALPN, []string{"h2", "http/1.1"}) {
+		t.Errorf("trojan ws tls outbound = %+v", de)
+	}
+	if ss := generated["ss"]; ss.Method != defaultSSMethod || ss.Password != "pass" || ss.TLS != nil {
+		t.Errorf("shadowsocks outbound = %+v", ss)
+	}
+
+	wantSkipped := []SkippedHost{
+		{Index: 3, Remark: "hidden", Reason: "hidden or disabled"},
+		{Index: 6, Remark: "xhttp", Reason: "unsupported network xhttp"},
+	}
+	if !slices.Equal(skipped, wantSkipped) {
+		t.Errorf("skipped = %+v, want %+v", skipped, wantSkipped)
+	}
+}
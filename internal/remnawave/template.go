@@ -0,0 +1,184 @@
+package remnawave
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Placeholders marked in the base Xray template. A placeholder is either the
+// bare string inside an array or an object whose "tag" is the placeholder; in
+// the latter case the object's other keys are copied onto every generated item.
+const (
+	proxyOutboundsPlaceholder = "{{PROXY_OUTBOUNDS}}"
+	proxyBalancerPlaceholder  = "{{PROXY_BALANCER}}"
+	proxyTagsPlaceholder      = "{{PROXY_TAGS}}"
+	ruleSetsPlaceholder       = "{{RULE_SETS}}"
+)
+
+// xrayTemplateData is everything generated per user that goes into the template.
+type xrayTemplateData struct {
+	Remarks          string
+	Outbounds        []Outbound
+	Balancer         Balancer
+	Observatory      *Observatory
+	BurstObservatory *BurstObservatory
+	Rules            []interface{}
+}
+
+func renderXrayTemplate(template []byte, data xrayTemplateData) ([]byte, error) {
+	generatedOutbounds, err := toJSONValues(data.Outbounds)
+	if err != nil {
+		return nil, err
+	}
+	generatedBalancers, err := toJSONValues([]Balancer{data.Balancer})
+	if err != nil {
+		return nil, err
+	}
+
+	replacements := map[string][]interface{}{
+		proxyOutboundsPlaceholder: generatedOutbounds,
+		proxyBalancerPlaceholder:  generatedBalancers,
+		ruleSetsPlaceholder:       data.Rules,
+	}
+	result, err := renderTemplate(template, replacements, proxyOutboundsPlaceholder, proxyBalancerPlaceholder)
+	if err != nil {
+		return nil, err
+	}
+
+	result["remarks"] = data.Remarks
+	delete(result, "observatory")
+	delete(result, "burstObservatory")
+	if data.Observatory != nil {
+		result["observatory"] = data.Observatory
+	}
+	if data.BurstObservatory != nil {
+		result["burstObservatory"] = data.BurstObservatory
+	}
+
+	return json.MarshalIndent(result, "", "  ")
+}
+
+// renderTemplate decodes a JSON template and splices the replacements into
+// it, failing when one of the required placeholders is missing.
+func renderTemplate(template []byte, replacements map[string][]interface{}, required ...string) (map[string]interface{}, error) {
+	base, err := decodeTemplate(template)
+	if err != nil {
+		return nil, err
+	}
+	return fillTemplate(base, replacements, required...)
+}
+
+func decodeTemplate(template []byte) (map[string]interface{}, error) {
+	if len(template) == 0 {
+		return nil, fmt.Errorf("template is not loaded")
+	}
+
+	var base map[string]interface{}
+	if err := json.Unmarshal(template, &base); err != nil {
+		return nil, fmt.Errorf("decoding template: %w", err)
+	}
+	return base, nil
+}
+
+// templateTags collects the tags of the template's own objects, leaving out
+// placeholders, so generated tags can steer clear of them.
+func templateTags(value interface{}) []string {
+	var tags []string
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if tag, ok := v["tag"].(string); ok && !strings.HasPrefix(tag, "{{") {
+			tags = append(tags, tag)
+		}
+		for _, item := range v {
+			tags = append(tags, templateTags(item)...)
+		}
+	case []interface{}:
+		for _, item := range v {
+			tags = append(tags, templateTags(item)...)
+		}
+	}
+	return tags
+}
+
+// fillTemplate splices the replacements into an already decoded template.
+func fillTemplate(base map[string]interface{}, replacements map[string][]interface{}, required ...string) (map[string]interface{}, error) {
+	found := make(map[string]bool)
+	splicePlaceholders(base, replacements, found)
+	for _, placeholder := range required {
+		if !found[placeholder] {
+			return nil, fmt.Errorf("template has no %s placeholder", placeholder)
+		}
+	}
+	return base, nil
+}
+
+func splicePlaceholders(value interface{}, replacements map[string][]interface{}, found map[string]bool) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = splicePlaceholders(item, replacements, found)
+		}
+		return v
+	case []interface{}:
+		result := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			placeholder, extra := placeholderOf(item)
+			generated, ok := replacements[placeholder]
+			if !ok {
+				result = append(result, splicePlaceholders(item, replacements, found))
+				continue
+			}
+			found[placeholder] = true
+			for _, g := range generated {
+				result = append(result, withExtraKeys(g, extra))
+			}
+		}
+		return result
+	default:
+		return v
+	}
+}
+
+func placeholderOf(item interface{}) (string, map[string]interface{}) {
+	switch v := item.(type) {
+	case string:
+		return v, nil
+	case map[string]interface{}:
+		if tag, ok := v["tag"].(string); ok {
+			return tag, v
+		}
+	}
+	return "", nil
+}
+
+func withExtraKeys(generated interface{}, extra map[string]interface{}) interface{} {
+	obj, ok := generated.(map[string]interface{})
+	if !ok || len(extra) == 0 {
+		return generated
+	}
+
+	merged := make(map[string]interface{}, len(obj)+len(extra))
+	for key, value := range obj {
+		merged[key] = value
+	}
+	for key, value := range extra {
+		if key != "tag" {
+			merged[key] = value
+		}
+	}
+	return merged
+}
+
+func toJSONValues(v interface{}) ([]interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("encoding generated values: %w", err)
+	}
+
+	var values []interface{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("decoding generated values: %w", err)
+	}
+	return values, nil
+}
@@ -0,0 +1,160 @@
+package remnawave
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+// decode turns a JSON literal into the values the template code works on.
+func decode(t *testing.T, doc string) interface{} {
+	t.Helper()
+	var v interface{}
+	if err := json.Unmarshal([]byte(doc), &v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestFillTemplate(t *testing.T) {
+	replacements := map[string][]interface{}{
+		proxyOutboundsPlaceholder: {map[string]interface{}{"tag": "proxy1"}, map[string]interface{}{"tag": "proxy2"}},
+		proxyBalancerPlaceholder:  {map[string]interface{}{"tag": "proxy-balancer"}},
+		proxyTagsPlaceholder:      {"proxy1", "proxy2"},
+		ruleSetsPlaceholder:       {map[string]interface{}{"outboundTag": "direct"}},
+	}
+
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{
+			name:     "outbounds",
+			template: `{"outbounds":["{{PROXY_OUTBOUNDS}}",{"tag":"direct"}]}`,
+			want:     `{"outbounds":[{"tag":"proxy1"},{"tag":"proxy2"},{"tag":"direct"}]}`,
+		},
+		{
+			name:     "outbounds object merges extra keys",
+			template: `{"outbounds":[{"tag":"{{PROXY_OUTBOUNDS}}","mux":{"enabled":true}},{"tag":"direct"}]}`,
+			want:     `{"outbounds":[{"mux":{"enabled":true},"tag":"proxy1"},{"mux":{"enabled":true},"tag":"proxy2"},{"tag":"direct"}]}`,
+		},
+		{
+			name:     "balancer",
+			template: `{"routing":{"balancers":["{{PROXY_BALANCER}}"]}}`,
+			want:     `{"routing":{"balancers":[{"tag":"proxy-balancer"}]}}`,
+		},
+		{
+			name:     "tags in nested arrays",
+			template: `{"outbounds":[{"tag":"auto","outbounds":["{{PROXY_TAGS}}"]},{"tag":"proxy","outbounds":["auto","{{PROXY_TAGS}}"]}]}`,
+			want:     `{"outbounds":[{"outbounds":["proxy1","proxy2"],"tag":"auto"},{"outbounds":["auto","proxy1","proxy2"],"tag":"proxy"}]}`,
+		},
+		{
+			name:     "rule sets before the template's rules",
+			template: `{"routing":{"rules":["{{RULE_SETS}}",{"outboundTag":"block"}]}}`,
+			want:     `{"routing":{"rules":[{"outboundTag":"direct"},{"outboundTag":"block"}]}}`,
+		},
+		{
+			name:     "unknown strings are kept",
+			template: `{"outbounds":["{{PROXY_OUTBOUNDS}}"],"note":["{{OTHER}}"]}`,
+			want:     `{"note":["{{OTHER}}"],"outbounds":[{"tag":"proxy1"},{"tag":"proxy2"}]}`,
+		},
+	}
+	for _, tt := range tests {
+		base := decode(t, tt.template).(map[string]interface{})
+		result, err := fillTemplate(base, replacements)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got, err := json.Marshal(result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: fillTemplate() =\n%s\nwant\n%s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFillTemplateEmptyReplacement(t *testing.T) {
+	base := decode(t, `{"routing":{"rules":["{{RULE_SETS}}",{"outboundTag":"block"}]}}`).(map[string]interface{})
+	result, err := fillTemplate(base, map[string][]interface{}{ruleSetsPlaceholder: nil}, ruleSetsPlaceholder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := json.Marshal(result)
+	if string(got) != `{"routing":{"rules":[{"outboundTag":"block"}]}}` {
+		t.Errorf("fillTemplate() = %s", got)
+	}
+}
+
+func TestRenderTemplateMissingPlaceholder(t *testing.T) {
+	replacements := map[string][]interface{}{
+		proxyOutboundsPlaceholder: {map[string]interface{}{"tag": "proxy1"}},
+		proxyBalancerPlaceholder:  {map[string]interface{}{"tag": "proxy-balancer"}},
+	}
+
+	tests := map[string]string{
+		"no outbounds": `{"outbounds":[{"tag":"direct"}],"routing":{"balancers":["{{PROXY_BALANCER}}"]}}`,
+		"no balancer":  `{"outbounds":["{{PROXY_OUTBOUNDS}}"],"routing":{"balancers":[]}}`,
+		"not an array": `{"outbounds":"{{PROXY_OUTBOUNDS}}","routing":{"balancers":["{{PROXY_BALANCER}}"]}}`,
+	}
+	for name, template := range tests {
+		_, err := renderTemplate([]byte(template), replacements, proxyOutboundsPlaceholder, proxyBalancerPlaceholder)
+		if err == nil || !strings.Contains(err.Error(), "placeholder") {
+			t.Errorf("%s: err = %v, want a missing placeholder error", name, err)
+		}
+	}
+
+	if _, err := renderTemplate(nil, replacements); err == nil {
+		t.Error("renderTemplate accepted an empty template")
+	}
+	if _, err := renderTemplate([]byte(`{"outbounds":[`), replacements); err == nil {
+		t.Error("renderTemplate accepted invalid JSON")
+	}
+}
+
+func TestRenderXrayTemplate(t *testing.T) {
+	for path, mux := range map[string]bool{"../../templates/v2ray/default.json": false, "../../templates/v2ray/mux_default.json": true} {
+		template, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		output, err := renderXrayTemplate(template, xrayTemplateData{
+			Remarks:          "🇳🇱 Netherlands",
+			Outbounds:        []Outbound{buildOutbound(RawHost{Protocol: "vless", Network: "tcp", TLS: "reality"}, "proxy1")},
+			Balancer:         Balancer{Tag: "proxy-balancer", Selector: []string{"proxy1"}, Strategy: Strategy{Type: "leastPing"}},
+			Observatory:      &Observatory{SubjectSelector: []string{"proxy1"}},
+			BurstObservatory: nil,
+			Rules:            []interface{}{map[string]interface{}{"outboundTag": "direct", "domain": []interface{}{"geosite:category-ru"}}},
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+
+		config := decode(t, string(output))
+		if field(config, "remarks") != "🇳🇱 Netherlands" {
+			t.Errorf("%s: remarks = %v", path, field(config, "remarks"))
+		}
+		if field(config, "outbounds", 0, "tag") != "proxy1" || field(config, "outbounds", 0, "protocol") != "vless" {
+			t.Errorf("%s: first outbound = %v", path, field(config, "outbounds", 0))
+		}
+		if got := field(config, "outbounds", 0, "mux", "enabled") == true; got != mux {
+			t.Errorf("%s: outbound mux enabled = %v, want %v", path, got, mux)
+		}
+		if field(config, "routing", "rules", 0, "outboundTag") != "direct" {
+			t.Errorf("%s: first rule = %v", path, field(config, "routing", "rules", 0))
+		}
+		if field(config, "routing", "balancers", 0, "tag") != "proxy-balancer" {
+			t.Errorf("%s: balancers = %v", path, field(config, "routing", "balancers"))
+		}
+		if field(config, "observatory") == nil || field(config, "burstObservatory") != nil {
+			t.Errorf("%s: observatory = %v, burstObservatory = %v", path, field(config, "observatory"), field(config, "burstObservatory"))
+		}
+		if strings.Contains(string(output), "{{") {
+			t.Errorf("%s: placeholders left in the output", path)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package resilience
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without calling the panel while it is considered
+// unhealthy.
+var ErrCircuitOpen = errors.New("panel circuit breaker is open")
+
+// Breaker opens after Threshold consecutive failures and lets a single trial
+// request through once Cooldown has passed. A successful trial closes it.
+type Breaker struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+// Allow reports whether a request may be sent to the panel now.
+func (b *Breaker) Allow() error {
+	if b == nil || b.Threshold <= 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.Threshold {
+		return nil
+	}
+	if time.Since(b.openedAt) < b.Cooldown || b.trial {
+		return ErrCircuitOpen
+	}
+	b.trial = true
+	return nil
+}
+
+// Record feeds the outcome of a panel call into the breaker.
+func (b *Breaker) Record(success bool) {
+	if b == nil || b.Threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trial = false
+	if success {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.Threshold {
+		b.openedAt = time.Now()
+	}
+}
+
+// Release gives up a trial slot without judging the panel, e.g. when the
+// client cancelled the request.
+func (b *Breaker) Release() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	b.trial = false
+	b.mu.Unlock()
+}
@@ -0,0 +1,62 @@
+package resilience
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	const cooldown = 20 * time.Millisecond
+
+	// Steps: "fail"/"ok" record an outcome, "release" gives up the trial,
+	// "wait" sleeps past the cooldown and "allow"/"deny" expect Allow to pass
+	// or to return ErrCircuitOpen.
+	tests := []struct {
+		name      string
+		threshold int
+		steps     []string
+	}{
+		{"stays closed below threshold", 3, []string{"fail", "fail", "allow", "ok", "fail", "fail", "allow"}},
+		{"opens at threshold", 3, []string{"fail", "fail", "fail", "deny", "deny"}},
+		{"single trial after cooldown", 2, []string{"fail", "fail", "deny", "wait", "allow", "deny"}},
+		{"successful trial closes", 2, []string{"fail", "fail", "wait", "allow", "ok", "allow", "allow"}},
+		{"failed trial reopens", 2, []string{"fail", "fail", "wait", "allow", "fail", "deny", "wait", "allow"}},
+		{"released trial can be retried", 2, []string{"fail", "fail", "wait", "allow", "release", "allow", "deny"}},
+		{"zero threshold disables", 0, []string{"fail", "fail", "fail", "allow"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &Breaker{Threshold: tt.threshold, Cooldown: cooldown}
+			for i, step := range tt.steps {
+				switch step {
+				case "fail":
+					b.Record(false)
+				case "ok":
+					b.Record(true)
+				case "release":
+					b.Release()
+				case "wait":
+					time.Sleep(cooldown + 5*time.Millisecond)
+				case "allow":
+					if err := b.Allow(); err != nil {
+						t.Fatalf("step %d: Allow() = %v, want nil", i, err)
+					}
+				case "deny":
+					if err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+						t.Fatalf("step %d: Allow() = %v, want ErrCircuitOpen", i, err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestNilBreaker(t *testing.T) {
+	var b *Breaker
+	b.Record(false)
+	b.Release()
+	if err := b.Allow(); err != nil {
+		t.Errorf("nil breaker Allow() = %v, want nil", err)
+	}
+}
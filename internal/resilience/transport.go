@@ -0,0 +1,93 @@
+package resilience
+
+import (
+	"context"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// Transport retries idempotent GETs on connection errors and 502/503/504
+// with jittered exponential backoff, and fails fast while Breaker is open.
+type Transport struct {
+	Next       http.RoundTripper
+	MaxRetries int
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+	Breaker    *Breaker
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	retries := t.MaxRetries
+	if !retryable(req) {
+		retries = 0
+	}
+
+	for attempt := 0; ; attempt++ {
+		if err := t.Breaker.Allow(); err != nil {
+			return nil, err
+		}
+
+		resp, err := t.Next.RoundTrip(req)
+		failed := isFailure(resp, err)
+		if err != nil && req.Context().Err() != nil {
+			// The client went away, the panel is not to blame.
+			t.Breaker.Release()
+			return nil, err
+		}
+		t.Breaker.Record(!failed)
+
+		if !failed || attempt >= retries {
+			return resp, err
+		}
+
+		if resp != nil {
+			resp.Body.Close()
+		}
+		slog.Warn("Retrying panel request", "url", req.URL.Path, "attempt", attempt+1, "error", err)
+
+		if err := sleep(req.Context(), t.backoff(attempt)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// backoff returns a random delay up to BaseDelay*2^attempt, capped by MaxDelay.
+func (t *Transport) backoff(attempt int) time.Duration {
+	delay := t.BaseDelay << attempt
+	if t.MaxDelay > 0 && (delay > t.MaxDelay || delay <= 0) {
+		delay = t.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return rand.N(delay) + 1
+}
+
+func retryable(req *http.Request) bool {
+	return req.Method == http.MethodGet && (req.Body == nil || req.Body == http.NoBody)
+}
+
+func isFailure(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func sleep(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
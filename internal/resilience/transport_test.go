@@ -0,0 +1,126 @@
+package resilience
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+var errConn = errors.New("connection refused")
+
+// scriptedTransport answers each call with the next outcome of script, a
+// status code or errConn when 0, repeating the last one when it runs out.
+type scriptedTransport struct {
+	script []int
+	calls  int
+}
+
+func (s *scriptedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	status := s.script[min(s.calls, len(s.script)-1)]
+	s.calls++
+	if status == 0 {
+		return nil, errConn
+	}
+	return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader("")), Request: req}, nil
+}
+
+func TestTransportRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		script     []int
+		retries    int
+		breaker    *Breaker
+		wantCalls  int
+		wantStatus int
+		wantErr    error
+	}{
+		{"success", http.MethodGet, []int{200}, 2, nil, 1, 200, nil},
+		{"fails twice then succeeds", http.MethodGet, []int{503, 502, 200}, 2, nil, 3, 200, nil},
+		{"connection error then success", http.MethodGet, []int{0, 200}, 2, nil, 2, 200, nil},
+		{"gives up after max retries", http.MethodGet, []int{504}, 2, nil, 3, 504, nil},
+		{"returns last connection error", http.MethodGet, []int{0}, 1, nil, 2, 0, errConn},
+		{"500 is not retried", http.MethodGet, []int{500, 200}, 2, nil, 1, 500, nil},
+		{"404 is not retried", http.MethodGet, []int{404, 200}, 2, nil, 1, 404, nil},
+		{"POST is not retried", http.MethodPost, []int{503, 200}, 2, nil, 1, 503, nil},
+		{"breaker stops retries", http.MethodGet, []int{503}, 5, &Breaker{Threshold: 2, Cooldown: time.Minute}, 2, 0, ErrCircuitOpen},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := &scriptedTransport{script: tt.script}
+			rt := &Transport{Next: next, MaxRetries: tt.retries, BaseDelay: time.Microsecond, MaxDelay: time.Millisecond, Breaker: tt.breaker}
+
+			req, _ := http.NewRequest(tt.method, "http://panel/api/sub/abc", nil)
+			resp, err := rt.RoundTrip(req)
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantStatus != 0 && (resp == nil || resp.StatusCode != tt.wantStatus) {
+				t.Errorf("resp = %v, want status %d", resp, tt.wantStatus)
+			}
+			if next.calls != tt.wantCalls {
+				t.Errorf("calls = %d, want %d", next.calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+// cancelingTransport cancels the request's context and fails like a client
+// that went away.
+type cancelingTransport struct {
+	cancel context.CancelFunc
+}
+
+func (c *cancelingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.cancel()
+	return nil, req.Context().Err()
+}
+
+func TestTransportCancelReleasesTrial(t *testing.T) {
+	breaker := &Breaker{Threshold: 1, Cooldown: time.Millisecond}
+	breaker.Record(false)
+	time.Sleep(2 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rt := &Transport{Next: &cancelingTransport{cancel: cancel}, MaxRetries: 2, Breaker: breaker}
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://panel/api/sub/abc", nil)
+	if _, err := rt.RoundTrip(req); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+
+	// The trial slot is free again and the cancel was not counted as a failure.
+	if err := breaker.Allow(); err != nil {
+		t.Errorf("Allow() after cancel = %v, want nil", err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	rt := &Transport{BaseDelay: 100 * time.Millisecond, MaxDelay: 300 * time.Millisecond}
+
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{0, 100 * time.Millisecond},
+		{1, 200 * time.Millisecond},
+		{2, 300 * time.Millisecond},
+		{5, 300 * time.Millisecond},
+		{70, 300 * time.Millisecond}, // the shift overflows
+	}
+	for _, tt := range tests {
+		for range 100 {
+			if delay := rt.backoff(tt.attempt); delay <= 0 || delay > tt.max {
+				t.Fatalf("backoff(%d) = %v, want in (0, %v]", tt.attempt, delay, tt.max)
+			}
+		}
+	}
+
+	if delay := (&Transport{}).backoff(3); delay != 0 {
+		t.Errorf("backoff without delays = %v, want 0", delay)
+	}
+}
@@ -1,15 +1,25 @@
 package rest
 
 import (
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"log/slog"
+	"net"
 	"net/http"
 	"remnawave-json/internal/config"
+	"remnawave-json/internal/orderedjson"
+	"remnawave-json/internal/proxyheader"
 	"remnawave-json/internal/remnawave"
+	"remnawave-json/internal/resilience"
+	"remnawave-json/internal/useragent"
+	"remnawave-json/internal/userselect"
+	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 )
@@ -17,37 +27,52 @@ import (
 func Direct(w http.ResponseWriter, r *http.Request) {
 	shortUuid := mux.Vars(r)["shortUuid"]
 
-	proxyURL := config.GetRemnaweveURL() + "/api/sub/" + shortUuid
-	httpReq, err := http.NewRequest(r.Method, proxyURL, r.Body)
+	resp, err := remnawave.GetClient().Subscription(r.Context(), r.Method, shortUuid, "", r.Body, r.Header)
 	if err != nil {
-		http.Error(w, "failed to create request", http.StatusInternalServerError)
+		http.Error(w, "failed to forward request", upstreamErrorStatus(err))
 		return
 	}
+	defer resp.Body.Close()
 
-	for key, values := range r.Header {
-		for _, value := range values {
-			httpReq.Header.Add(key, value)
-		}
+	proxyheader.CopyResponse(w.Header(), resp.Header)
+
+	w.WriteHeader(resp.StatusCode)
+
+	_, err = io.Copy(w, resp.Body)
+	if err != nil {
+		http.Error(w, "failed to copy response body", http.StatusInternalServerError)
 	}
+}
 
-	resp, err := config.GetHttpClient().Do(httpReq)
+// RawLinks serves the subscription links as plain text, one per line.
+func RawLinks(w http.ResponseWriter, r *http.Request) {
+	writeLinks(w, r, false)
+}
+
+// Base64Links serves the subscription links base64 encoded, as most clients
+// expect from a plain subscription URL.
+func Base64Links(w http.ResponseWriter, r *http.Request) {
+	writeLinks(w, r, true)
+}
+
+func writeLinks(w http.ResponseWriter, r *http.Request, encode bool) {
+	shortUuid := mux.Vars(r)["shortUuid"]
+	sub, err := remnawave.GetClient().SubscriptionInfo(r.Context(), shortUuid, r.Header.Get("User-Agent"))
 	if err != nil {
-		http.Error(w, "failed to forward request", http.StatusBadGateway)
+		slog.Error("Get links error", "error", err)
+		http.Error(w, "failed to get subscription", upstreamErrorStatus(err))
 		return
 	}
-	defer resp.Body.Close()
 
-	for key, values := range resp.Header {
-		for _, value := range values {
-			w.Header().Add(key, value)
-		}
+	links := strings.Join(sub.Links, "\n")
+	if encode {
+		links = base64.StdEncoding.EncodeToString([]byte(links))
 	}
 
-	w.WriteHeader(resp.StatusCode)
-
-	_, err = io.Copy(w, resp.Body)
-	if err != nil {
-		http.Error(w, "failed to copy response body", http.StatusInternalServerError)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.WriteString(w, links); err != nil {
+		slog.Error("Write links error", "error", err)
 	}
 }
 
@@ -64,10 +89,10 @@ type WebPageUser struct {
 func WebPage(w http.ResponseWriter, r *http.Request) {
 	shortUuid := mux.Vars(r)["shortUuid"]
 	header := r.Header.Get("User-Agent")
-	sub, err := remnawave.GetSubscription(shortUuid, header)
+	sub, err := remnawave.GetClient().SubscriptionInfo(r.Context(), shortUuid, header)
 	if err != nil {
-		slog.Error("Get Json Error", err)
-		http.Error(w, "Ошибка получения подписки", http.StatusInternalServerError)
+		slog.Error("Get Json Error", "error", err)
+		http.Error(w, "Ошибка получения подписки", upstreamErrorStatus(err))
 		return
 	}
 
@@ -93,261 +118,259 @@ func WebPage(w http.ResponseWriter, r *http.Request) {
 
 	err = config.GetWebPageTemplate().Execute(w, data)
 	if err != nil {
-		slog.Error("Execute Json Error", err)
+		slog.Error("Execute Json Error", "error", err)
 		http.Error(w, "Ошибка заполнения шаблона", http.StatusInternalServerError)
 	}
 }
 
 func V2rayJson(w http.ResponseWriter, r *http.Request) {
-	shortUuid := mux.Vars(r)["shortUuid"]
+	serveV2rayJson(w, r, false)
+}
 
-	proxyURL := config.GetRemnaweveURL() + "/api/sub/" + shortUuid + "/v2ray-json"
-	httpReq, err := http.NewRequest(r.Method, proxyURL, r.Body)
-	if err != nil {
-		http.Error(w, "failed to create request", http.StatusInternalServerError)
-		return
-	}
+// HappJson serves the panel's v2ray-json with the user's Happ routing
+// profile in the routing header.
+func HappJson(w http.ResponseWriter, r *http.Request) {
+	serveV2rayJson(w, r, true)
+}
 
-	for key, values := range r.Header {
-		for _, value := range values {
-			httpReq.Header.Add(key, value)
-		}
-	}
+// serveV2rayJson proxies the panel's v2ray-json, rewriting it when a
+// transform applies. The raw subscription, needed by some transforms and the
+// Happ routing selectors, is fetched alongside the panel call.
+func serveV2rayJson(w http.ResponseWriter, r *http.Request, happRouting bool) {
+	shortUuid := mux.Vars(r)["shortUuid"]
+	needUser := happRouting && config.GetHappRouting().NeedsUser()
+	raw := fetchRaw(r, shortUuid, needUser)
 
-	resp, err := config.GetHttpClient().Do(httpReq)
+	resp, err := remnawave.GetClient().Subscription(r.Context(), r.Method, shortUuid, "v2ray-json", r.Body, r.Header)
 	if err != nil {
-		http.Error(w, "failed to forward request", http.StatusBadGateway)
+		http.Error(w, "failed to forward request", upstreamErrorStatus(err))
 		return
 	}
 	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		http.Error(w, "failed to read response body", http.StatusInternalServerError)
-		return
+	if happRouting {
+		setHappRouting(w, selectedUser(r, shortUuid, raw, needUser), "")
 	}
 
-	if len(body) == 0 {
-		for key, values := range resp.Header {
-			for _, value := range values {
-				w.Header().Add(key, value)
-			}
-		}
-
+	transform := v2rayTransform(r, shortUuid, raw)
+	if transform == nil || resp.StatusCode != http.StatusOK {
+		proxyheader.CopyResponse(w.Header(), resp.Header)
 		w.WriteHeader(resp.StatusCode)
+		if _, err := io.Copy(w, resp.Body); err != nil {
+			slog.Error("Error copying response body", "error", err)
+		}
 		return
 	}
 
-	data, err := DecodeJSON(body)
+	body, err := readLimited(resp.Body, config.GetMaxRewriteBody())
 	if err != nil {
-		log.Printf("JSON parse error: %v", err)
-	} else {
-		//if config.GetRuHostName() != "" {
-		//	rawSub, err := remnawave.GetRawSubscription(shortUuid, r.Header.Get("User-Agent"))
-		//	if err != nil {
-		//		log.Printf("JSON parse error: %v", err)
-		//	}
-		//
-		//	ruHost := findRawHostByRemark(rawSub, config.GetRuHostName())
-		//	if ruHost != nil {
-		//		UpdateRuOutbound(data, ruHost)
-		//	}
-		//}
-	}
-
-	if _, exists := config.GetExceptRuRulesUsers()[shortUuid]; exists {
-		if data != nil {
-			data = CleanRURules(data)
-		} else {
-			fmt.Println("data is nil")
-		}
+		slog.Error("Error reading v2ray-json response", "shortUuid", shortUuid, "error", err)
+		http.Error(w, "failed to read response body", http.StatusBadGateway)
+		return
 	}
-	for key, values := range resp.Header {
-		for _, value := range values {
-			w.Header().Add(key, value)
-		}
+
+	proxyheader.CopyResponse(w.Header(), resp.Header)
+	if rewritten, err := orderedjson.Rewrite(body, transform); err != nil {
+		slog.Error("Failed to rewrite v2ray-json, serving it unchanged", "shortUuid", shortUuid, "error", err)
+	} else {
+		body = rewritten
+		setBodyHeaders(w.Header(), body)
 	}
 
 	w.WriteHeader(resp.StatusCode)
-	if data != nil {
-		if err := json.NewEncoder(w).Encode(data); err != nil {
-			http.Error(w, "failed to encode JSON", http.StatusInternalServerError)
-		}
+	if _, err := w.Write(body); err != nil {
+		slog.Error("Write v2ray-json error", "shortUuid", shortUuid, "error", err)
 	}
-
 }
 
-func CleanRURules(data interface{}) interface{} {
-	arr, ok := data.([]interface{})
-	if !ok {
-		return data
-	}
-
-	for i, v := range arr {
-		obj, ok := v.(map[string]interface{})
-		if !ok {
-			continue
-		}
-
-		routing, ok := obj["routing"].(map[string]interface{})
-		if !ok {
-			continue
-		}
+// setBodyHeaders describes a rewritten body, replacing the upstream validators
+// that no longer match it.
+func setBodyHeaders(h http.Header, body []byte) {
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	h.Set("ETag", fmt.Sprintf(`"%x"`, sha256.Sum256(body)))
+	h.Del("Last-Modified")
+}
 
-		if rules, ok := routing["rules"].([]interface{}); ok {
-			filtered := make([]interface{}, 0, len(rules))
-			for _, r := range rules {
-				if rule, ok := r.(map[string]interface{}); ok {
-					if tag, ok := rule["outboundTag"].(string); ok && tag == "RU" {
-						continue
-					}
-				}
-				filtered = append(filtered, r)
-			}
-			routing["rules"] = filtered
-		}
+// errBodyTooLarge is returned by readLimited when a body exceeds its limit.
+var errBodyTooLarge = errors.New("response body too large")
 
-		arr[i] = obj
+// readLimited reads at most limit bytes, failing instead of truncating.
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
 	}
-
-	return arr
+	if int64(len(body)) > limit {
+		return nil, errBodyTooLarge
+	}
+	return body, nil
 }
 
-func HappJson(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("routing", config.GetHappRouting())
-	r.Header.Set("User-Agent", r.Header.Get("User-Agent"))
-	V2rayJson(w, r)
+// setHappRouting sets the routing header to the Happ profile picked for the
+// user. Without any configured routing fallback is sent, if set.
+func setHappRouting(w http.ResponseWriter, user userselect.User, fallback string) {
+	routing := config.GetHappRouting().For(user)
+	if routing == "" {
+		routing = fallback
+	}
+	if routing != "" {
+		w.Header().Set("routing", routing)
+	}
 }
 
+// BalancerConfig serves the balancer config to clients that understand
+// burstObservatory and falls back to HappJson for older versions.
 func BalancerConfig(w http.ResponseWriter, r *http.Request) {
-	r.Header.Set("User-Agent", r.Header.Get("User-Agent"))
+	client := useragent.Parse(r.Header.Get("User-Agent"))
+	if !client.Supports(useragent.Balancer) {
+		HappJson(w, r)
+		return
+	}
 	BalancerJson(w, r)
 }
 
+// BalancerJson builds the balancer config from the raw subscription. The
+// panel's v2ray-json is only fetched, and passed through, when that fails for
+// a known user.
 func BalancerJson(w http.ResponseWriter, r *http.Request) {
 	shortUuid := mux.Vars(r)["shortUuid"]
 
-	proxyURL := config.GetRemnaweveURL() + "/api/sub/" + shortUuid + "/v2ray-json"
-	httpReq, err := http.NewRequest(r.Method, proxyURL, r.Body)
+	rawData, err := remnawave.GetClient().RawSubscription(r.Context(), shortUuid, r.Header)
 	if err != nil {
-		http.Error(w, "failed to create request", http.StatusInternalServerError)
+		slog.Error("Failed to get raw subscription", "format", "balancer", "shortUuid", shortUuid, "error", err)
+		if isUnknownUser(err) {
+			http.Error(w, "subscription not found", upstreamErrorStatus(err))
+			return
+		}
+		serveV2rayFallback(w, r)
 		return
 	}
 
-	for key, values := range r.Header {
-		for _, value := range values {
-			httpReq.Header.Add(key, value)
+	client := useragent.Parse(r.Header.Get("User-Agent"))
+	xrayConfig, skipped, err := remnawave.ConvertToXrayConfig(rawData, client)
+	if len(skipped) > 0 {
+		slog.Warn("Skipped hosts in balancer config", "shortUuid", shortUuid, "skipped", skipped)
+		for _, host := range skipped {
+			w.Header().Add("X-Skipped-Host", fmt.Sprintf("%d; %s", host.Index, host.Reason))
 		}
 	}
-
-	resp, err := config.GetHttpClient().Do(httpReq)
 	if err != nil {
-		http.Error(w, "failed to forward request", http.StatusBadGateway)
+		slog.Error("Failed to build config", "format", "balancer", "shortUuid", shortUuid, "error", err)
+		serveV2rayFallback(w, r)
 		return
 	}
-	defer resp.Body.Close()
 
-	for key, values := range resp.Header {
-		fmt.Println(key, values)
-		for _, value := range values {
-			w.Header().Add(key, value)
-		}
+	proxyheader.CopyResponseMap(w.Header(), rawData.Response.Headers)
+	setHappRouting(w, rawData.Response.User.Selected(), config.GetBalancerHappRouting())
+	setBodyHeaders(w.Header(), xrayConfig)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := w.Write(xrayConfig); err != nil {
+		slog.Error("Write balancer config error", "shortUuid", shortUuid, "error", err)
 	}
+}
 
-	rawData, err := remnawave.GetRawSubscription(shortUuid, r)
+// serveV2rayFallback passes the panel's v2ray-json through unchanged when no
+// balancer config could be built.
+func serveV2rayFallback(w http.ResponseWriter, r *http.Request) {
+	resp, err := remnawave.GetClient().Subscription(r.Context(), r.Method, mux.Vars(r)["shortUuid"], "v2ray-json", r.Body, r.Header)
 	if err != nil {
-		log.Printf("Failed to get raw subscription: %v", err)
+		http.Error(w, "failed to forward request", upstreamErrorStatus(err))
 		return
 	}
+	defer resp.Body.Close()
+
+	proxyheader.CopyResponse(w.Header(), resp.Header)
+	writeUpstreamResponse(w, resp)
+}
+
+func SingBox(w http.ResponseWriter, r *http.Request) {
+	serveGenerated(w, r, "sing-box", remnawave.ConvertToSingBoxConfig, "application/json; charset=utf-8")
+}
+
+func Mihomo(w http.ResponseWriter, r *http.Request) {
+	serveGenerated(w, r, "mihomo", remnawave.ConvertToMihomoConfig, "text/yaml; charset=utf-8")
+}
+
+// converter builds a client config from the raw subscription, listing the
+// hosts it had to leave out.
+type converter func(*remnawave.ResponseConverterWrapper) ([]byte, []remnawave.SkippedHost, error)
 
-	xrayConfig, err := remnawave.ConvertToXrayConfig(rawData)
+// serveGenerated builds a config from the raw subscription with convert and
+// serves it with the panel's subscription headers. When the user is known but
+// no config can be built the request falls through to Direct.
+func serveGenerated(w http.ResponseWriter, r *http.Request, format string, convert converter, contentType string) {
+	shortUuid := mux.Vars(r)["shortUuid"]
+
+	rawData, err := remnawave.GetClient().RawSubscription(r.Context(), shortUuid, r.Header)
 	if err != nil {
-		log.Printf("Failed to convert to Xray config: %v", err)
-		w.WriteHeader(http.StatusOK)
+		slog.Error("Failed to get raw subscription", "format", format, "shortUuid", shortUuid, "error", err)
+		if isUnknownUser(err) {
+			http.Error(w, "subscription not found", upstreamErrorStatus(err))
+			return
+		}
+		Direct(w, r)
 		return
 	}
 
-	data, err := DecodeJSON(xrayConfig)
+	body, skipped, err := convert(rawData)
+	if len(skipped) > 0 {
+		slog.Warn("Skipped hosts in generated config", "format", format, "shortUuid", shortUuid, "skipped", skipped)
+	}
 	if err != nil {
-		log.Printf("JSON parse error: %v", err)
+		slog.Error("Failed to build config", "format", format, "shortUuid", shortUuid, "error", err)
+		Direct(w, r)
+		return
 	}
 
-	//if _, exists := config.GetExceptRuRulesUsers()[shortUuid]; exists {
-	//	data = CleanRURules(data)
-	//}
-	//for key, values := range resp.Header {
-	//	for _, value := range values {
-	//		w.Header().Add(key, value)
-	//	}
-	//}
-
-	w.Header().Set("routing", "happ://routing/onadd/eyJOYW1lIjoiU0VHQSBWUE4iLCJHbG9iYWxQcm94eSI6InRydWUiLCJSZW1vdGVETlNUeXBlIjoiRG9IIiwiUmVtb3RlRE5TRG9tYWluIjoiIiwiUmVtb3RlRE5TSVAiOiIiLCJEb21lc3RpY0ROU1R5cGUiOiJEb1UiLCJEb21lc3RpY0ROU0RvbWFpbiI6IiIsIkRvbWVzdGljRE5TSVAiOiIiLCJHZW9pcHVybCI6Imh0dHBzOi8vZ2l0aHViLmNvbS9mcmF5WlYvc2ltcGxlLXJ1LWdlb2lwL3JlbGVhc2VzL2xhdGVzdC9kb3dubG9hZC9nZW9pcC5kYXQiLCJHZW9zaXRldXJsIjoiaHR0cHM6Ly9naXRodWIuY29tL2ZyYXlaVi9zaW1wbGUtcnUtZ2Vvc2l0ZS9yZWxlYXNlcy9sYXRlc3QvZG93bmxvYWQvZ2Vvc2l0ZS5kYXQiLCJMYXN0VXBkYXRlZCI6IiIsIkRuc0hvc3RzIjp7fSwiRGlyZWN0U2l0ZXMiOltdLCJEaXJlY3RJcCI6W10sIlByb3h5U2l0ZXMiOltdLCJQcm94eUlwIjpbXSwiQmxvY2tTaXRlcyI6W10sIkJsb2NrSXAiOltdLCJEb21haW5TdHJhdGVneSI6IklQSWZOb25NYXRjaCIsIkZha2VETlMiOiJmYWxzZSIsIlVzZUNodW5rRmlsZXMiOiJ0cnVlIn0=")
-
+	proxyheader.CopyResponseMap(w.Header(), rawData.Response.Headers)
+	for _, host := range skipped {
+		w.Header().Add("X-Skipped-Host", fmt.Sprintf("%d; %s", host.Index, host.Reason))
+	}
+	w.Header().Set("Content-Type", contentType)
 	w.WriteHeader(http.StatusOK)
 
-	if err := json.NewEncoder(w).Encode(data); err != nil {
-		http.Error(w, "failed to encode JSON", http.StatusInternalServerError)
+	if _, err := w.Write(body); err != nil {
+		slog.Error("Write generated config error", "format", format, "error", err)
 	}
 }
 
-func DecodeJSON(body []byte) (interface{}, error) {
-	var data interface{}
-	err := json.Unmarshal(body, &data)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode JSON: %w", err)
+// upstreamErrorStatus maps a failed panel call to the status returned to the
+// client: 404/410 for unknown or revoked users, 504 on timeouts, 503 while the
+// circuit breaker is open and 502 otherwise.
+func upstreamErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, remnawave.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, remnawave.ErrGone):
+		return http.StatusGone
+	case isTimeout(err):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, resilience.ErrCircuitOpen):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusBadGateway
 	}
-	return data, nil
 }
 
-func UpdateRuOutbound(data interface{}, host *remnawave.RawHost) {
-	if arr, ok := data.([]interface{}); ok {
-		for _, v := range arr {
-			UpdateRuOutbound(v, host)
-		}
-		return
-	}
+func isUnknownUser(err error) bool {
+	return errors.Is(err, remnawave.ErrNotFound) || errors.Is(err, remnawave.ErrGone)
+}
 
-	if m, ok := data.(map[string]interface{}); ok {
-		if outbounds, exists := m["outbounds"]; exists {
-			if obs, ok := outbounds.([]interface{}); ok {
-				for _, ob := range obs {
-					if obMap, ok := ob.(map[string]interface{}); ok {
-						if tag, hasTag := obMap["tag"]; hasTag && tag == config.GetRuOutboundName() {
-
-							if settings, ok := obMap["settings"].(map[string]interface{}); ok {
-								if vnextArr, ok := settings["vnext"].([]interface{}); ok && len(vnextArr) > 0 {
-									if vnext, ok := vnextArr[0].(map[string]interface{}); ok {
-										if usersArr, ok := vnext["users"].([]interface{}); ok && len(usersArr) > 0 {
-											if user, ok := usersArr[0].(map[string]interface{}); ok {
-												user["id"] = host.Password.VlessPassword
-											}
-										}
-									}
-								}
-							}
-
-							if streamSettings, ok := obMap["streamSettings"].(map[string]interface{}); ok {
-								if realitySettings, ok := streamSettings["realitySettings"].(map[string]interface{}); ok {
-									realitySettings["publicKey"] = host.PublicKey
-									realitySettings["shortId"] = host.ShortID
-								}
-							}
-						}
-					}
-				}
-			}
-		}
-		for _, v := range m {
-			UpdateRuOutbound(v, host)
-		}
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
 	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
 }
 
-func findRawHostByRemark(resp *remnawave.Response, remark string) *remnawave.RawHost {
-	for i, host := range resp.RawHosts {
-		if host.Remark == remark {
-			return &resp.RawHosts[i]
-		}
+// writeUpstreamResponse falls back to the panel's own v2ray-json when the
+// balancer config can't be built. Headers are expected to be copied already.
+func writeUpstreamResponse(w http.ResponseWriter, resp *http.Response) {
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		slog.Error("Copy upstream body error", "error", err)
 	}
-	return nil
 }
@@ -0,0 +1,362 @@
+package rest
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"remnawave-json/internal/config"
+	"remnawave-json/internal/orderedjson"
+	"remnawave-json/internal/patch"
+	"remnawave-json/internal/remnawave"
+	"remnawave-json/internal/useragent"
+	"remnawave-json/internal/userselect"
+)
+
+// rawFetch is a raw subscription request running alongside the v2ray-json one.
+type rawFetch struct {
+	done chan struct{}
+	data *remnawave.ResponseConverterWrapper
+	err  error
+}
+
+// fetchRaw starts loading the raw subscription when the v2ray-json rewrite,
+// or the caller when needUser is set, will need it and returns nil otherwise.
+func fetchRaw(r *http.Request, shortUuid string, needUser bool) *rawFetch {
+	if !needUser && config.GetRuHostName() == "" && !patch.NeedsUser(config.GetV2rayPatches()) {
+		return nil
+	}
+
+	f := &rawFetch{done: make(chan struct{})}
+	go func() {
+		defer close(f.done)
+		f.data, f.err = remnawave.GetClient().RawSubscription(r.Context(), shortUuid, r.Header)
+	}()
+	return f
+}
+
+func (f *rawFetch) wait() (*remnawave.ResponseConverterWrapper, error) {
+	if f == nil {
+		return nil, errors.New("raw subscription not requested")
+	}
+	<-f.done
+	return f.data, f.err
+}
+
+// selectedUser describes the requesting user for selectors. Username, tag and
+// squads are only filled in, from the raw subscription, when needUser is set.
+func selectedUser(r *http.Request, shortUuid string, raw *rawFetch, needUser bool) userselect.User {
+	user := userselect.User{ShortUuid: shortUuid}
+	if needUser {
+		if rawData, err := raw.wait(); err != nil {
+			slog.Warn("User not loaded, matching by shortUuid and client only", "shortUuid", shortUuid, "error", err)
+		} else {
+			user = rawData.Response.User.Selected()
+			user.ShortUuid = shortUuid
+		}
+	}
+	user.Client = useragent.Parse(r.Header.Get("User-Agent")).Name
+	return user
+}
+
+// v2rayTransform returns the rewrite V2rayJson applies for this user: the RU
+// credential injection, the RU cleanup for EXCEPT_RU_RULES_USERS and the
+// matching patches, in that order. It is nil when the panel response can be
+// passed through untouched.
+func v2rayTransform(r *http.Request, shortUuid string, raw *rawFetch) func(interface{}) interface{} {
+	var steps []func(interface{}) interface{}
+	if host := ruHost(shortUuid, raw); host != nil {
+		steps = append(steps, func(data interface{}) interface{} {
+			return UpdateRuOutbound(data, host)
+		})
+	}
+
+	if _, ok := config.GetExceptRuRulesUsers()[shortUuid]; ok {
+		steps = append(steps, CleanRURules)
+	}
+
+	if patches := matchingPatches(r, shortUuid, raw); len(patches) > 0 {
+		steps = append(steps, func(data interface{}) interface{} {
+			data, err := patch.Apply(patches, data)
+			if err != nil {
+				slog.Warn("Some v2ray patches were not applied", "shortUuid", shortUuid, "error", err)
+			}
+			return data
+		})
+	}
+
+	if len(steps) == 0 {
+		return nil
+	}
+	return func(data interface{}) interface{} {
+		for _, step := range steps {
+			data = step(data)
+		}
+		return data
+	}
+}
+
+// ruHost finds the user's RU_USER_HOST host, whose credentials go into the RU
+// outbound.
+func ruHost(shortUuid string, raw *rawFetch) *remnawave.RawHost {
+	if config.GetRuHostName() == "" {
+		return nil
+	}
+
+	rawData, err := raw.wait()
+	if err != nil {
+		slog.Warn("Raw subscription not loaded, RU outbound left as is", "shortUuid", shortUuid, "error", err)
+		return nil
+	}
+
+	host := findRawHost(rawData.Response.RawHosts, config.GetRuHostMatch(), config.GetRuHostName())
+	if host == nil {
+		slog.Warn("RU host not found", "shortUuid", shortUuid, "match", config.GetRuHostMatch(), "host", config.GetRuHostName())
+	}
+	return host
+}
+
+// matchingPatches selects the configured patches for the requesting user.
+func matchingPatches(r *http.Request, shortUuid string, raw *rawFetch) []patch.Patch {
+	patches := config.GetV2rayPatches()
+	if len(patches) == 0 {
+		return nil
+	}
+	return patch.Select(patches, selectedUser(r, shortUuid, raw, patch.NeedsUser(patches)))
+}
+
+// UpdateRuOutbound writes the user's credentials from host into the
+// RU_OUTBOUND_NAME outbound of every config in data.
+func UpdateRuOutbound(data interface{}, host *remnawave.RawHost) interface{} {
+	return updateOutbound(config.GetRuOutboundName(), host)(data)
+}
+
+// updateOutbound returns a transform that copies the credentials of host into
+// the outbound tagged tag, according to the outbound's protocol: the UUID for
+// vless, the password for trojan and the password and method for shadowsocks.
+// Reality keys are taken over when the host has them.
+func updateOutbound(tag string, host *remnawave.RawHost) func(interface{}) interface{} {
+	return func(data interface{}) interface{} {
+		configs, ok := data.([]interface{})
+		if !ok {
+			configs = []interface{}{data}
+		}
+
+		for _, v := range configs {
+			cfg, ok := v.(*orderedjson.Object)
+			if !ok {
+				continue
+			}
+			outbounds, _ := arrayAt(cfg, "outbounds")
+			for _, item := range outbounds {
+				if outbound, ok := item.(*orderedjson.Object); ok && stringAt(outbound, "tag") == tag {
+					setCredentials(outbound, host)
+				}
+			}
+		}
+		return data
+	}
+}
+
+func setCredentials(outbound *orderedjson.Object, host *remnawave.RawHost) {
+	settings, _ := objectAt(outbound, "settings")
+	if settings != nil {
+		switch stringAt(outbound, "protocol") {
+		case "vless":
+			vnext, _ := arrayAt(settings, "vnext")
+			for _, server := range objectsOf(vnext) {
+				users, _ := arrayAt(server, "users")
+				for _, user := range objectsOf(users) {
+					user.Set("id", host.Password.VlessPassword)
+				}
+			}
+		case "trojan":
+			servers, _ := arrayAt(settings, "servers")
+			for _, server := range objectsOf(servers) {
+				server.Set("password", host.Password.TrojanPassword)
+			}
+		case "shadowsocks":
+			servers, _ := arrayAt(settings, "servers")
+			for _, server := range objectsOf(servers) {
+				server.Set("password", host.Password.SSPassword)
+				if host.ProtocolOptions != nil && host.ProtocolOptions.SS != nil && host.ProtocolOptions.SS.Method != nil {
+					server.Set("method", *host.ProtocolOptions.SS.Method)
+				}
+			}
+		}
+	}
+
+	if streamSettings, ok := objectAt(outbound, "streamSettings"); ok {
+		if reality, ok := objectAt(streamSettings, "realitySettings"); ok {
+			if host.PublicKey != "" {
+				reality.Set("publicKey", host.PublicKey)
+			}
+			if host.ShortID != "" {
+				reality.Set("shortId", host.ShortID)
+			}
+		}
+	}
+}
+
+// findRawHost returns the host whose remark, tag or inbound tag, as chosen by
+// match, equals value.
+func findRawHost(hosts []remnawave.RawHost, match, value string) *remnawave.RawHost {
+	for i, host := range hosts {
+		var key string
+		switch match {
+		case "tag":
+			if host.DbData.Tag != nil {
+				key = *host.DbData.Tag
+			}
+		case "inboundTag":
+			key = host.DbData.InboundTag
+		default:
+			key = host.Remark
+		}
+		if key == value {
+			return &hosts[i]
+		}
+	}
+	return nil
+}
+
+// CleanRURules removes the RU_OUTBOUND_NAME outbound and everything routed to
+// it from every config in data.
+func CleanRURules(data interface{}) interface{} {
+	return removeOutbound(config.GetRuOutboundName())(data)
+}
+
+// removeOutbound returns a transform that drops the outbound tagged tag from
+// an Xray config or an array of them, along with the routing rules sending
+// traffic to it, its place in balancer selectors and observatories, and the
+// DNS servers whose queries were routed to it.
+func removeOutbound(tag string) func(interface{}) interface{} {
+	return func(data interface{}) interface{} {
+		if arr, ok := data.([]interface{}); ok {
+			for _, v := range arr {
+				if obj, ok := v.(*orderedjson.Object); ok {
+					removeOutboundFrom(obj, tag)
+				}
+			}
+			return arr
+		}
+		if obj, ok := data.(*orderedjson.Object); ok {
+			removeOutboundFrom(obj, tag)
+		}
+		return data
+	}
+}
+
+func removeOutboundFrom(cfg *orderedjson.Object, tag string) {
+	if outbounds, ok := arrayAt(cfg, "outbounds"); ok {
+		cfg.Set("outbounds", filterObjects(outbounds, func(outbound *orderedjson.Object) bool {
+			return stringAt(outbound, "tag") == tag
+		}))
+	}
+
+	for _, key := range []string{"observatory", "burstObservatory"} {
+		if observatory, ok := objectAt(cfg, key); ok {
+			removeFromSelector(observatory, "subjectSelector", tag)
+		}
+	}
+
+	routing, ok := objectAt(cfg, "routing")
+	if !ok {
+		return
+	}
+
+	removedBalancers := make(map[string]bool)
+	if balancers, ok := arrayAt(routing, "balancers"); ok {
+		routing.Set("balancers", filterObjects(balancers, func(balancer *orderedjson.Object) bool {
+			if stringAt(balancer, "fallbackTag") == tag {
+				balancer.Delete("fallbackTag")
+			}
+			if !removeFromSelector(balancer, "selector", tag) {
+				return false
+			}
+			removedBalancers[stringAt(balancer, "tag")] = true
+			return true
+		}))
+	}
+
+	removedInbounds := make(map[string]bool)
+	if rules, ok := arrayAt(routing, "rules"); ok {
+		routing.Set("rules", filterObjects(rules, func(rule *orderedjson.Object) bool {
+			if stringAt(rule, "outboundTag") != tag && !removedBalancers[stringAt(rule, "balancerTag")] {
+				return false
+			}
+			inboundTags, _ := arrayAt(rule, "inboundTag")
+			for _, inbound := range inboundTags {
+				if s, ok := inbound.(string); ok {
+					removedInbounds[s] = true
+				}
+			}
+			return true
+		}))
+	}
+
+	if dns, ok := objectAt(cfg, "dns"); ok && len(removedInbounds) > 0 {
+		if servers, ok := arrayAt(dns, "servers"); ok {
+			dns.Set("servers", filterObjects(servers, func(server *orderedjson.Object) bool {
+				return removedInbounds[stringAt(server, "tag")]
+			}))
+		}
+	}
+}
+
+// removeFromSelector drops tag from the selector list at key and reports
+// whether the list is left empty.
+func removeFromSelector(obj *orderedjson.Object, key, tag string) bool {
+	selector, ok := arrayAt(obj, key)
+	if !ok {
+		return false
+	}
+	kept := make([]interface{}, 0, len(selector))
+	for _, v := range selector {
+		if v != tag {
+			kept = append(kept, v)
+		}
+	}
+	obj.Set(key, kept)
+	return len(kept) == 0
+}
+
+// filterObjects returns items without the objects for which remove is true.
+func filterObjects(items []interface{}, remove func(*orderedjson.Object) bool) []interface{} {
+	kept := make([]interface{}, 0, len(items))
+	for _, item := range items {
+		if obj, ok := item.(*orderedjson.Object); ok && remove(obj) {
+			continue
+		}
+		kept = append(kept, item)
+	}
+	return kept
+}
+
+// objectsOf returns the objects among items.
+func objectsOf(items []interface{}) []*orderedjson.Object {
+	objects := make([]*orderedjson.Object, 0, len(items))
+	for _, item := range items {
+		if obj, ok := item.(*orderedjson.Object); ok {
+			objects = append(objects, obj)
+		}
+	}
+	return objects
+}
+
+func objectAt(obj *orderedjson.Object, key string) (*orderedjson.Object, bool) {
+	v, _ := obj.Get(key)
+	child, ok := v.(*orderedjson.Object)
+	return child, ok
+}
+
+func arrayAt(obj *orderedjson.Object, key string) ([]interface{}, bool) {
+	v, _ := obj.Get(key)
+	arr, ok := v.([]interface{})
+	return arr, ok
+}
+
+func stringAt(obj *orderedjson.Object, key string) string {
+	v, _ := obj.Get(key)
+	s, _ := v.(string)
+	return s
+}
@@ -0,0 +1,105 @@
+package rest
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"remnawave-json/internal/orderedjson"
+	"remnawave-json/internal/remnawave"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files")
+
+// testGolden rewrites every testdata/<dir>/*.input.json with transform and
+// compares the result with the matching .golden.json file.
+func testGolden(t *testing.T, dir string, transform func(interface{}) interface{}) {
+	t.Helper()
+
+	inputs, err := filepath.Glob(filepath.Join("testdata", dir, "*.input.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inputs) == 0 {
+		t.Fatal("no golden inputs found")
+	}
+
+	for _, input := range inputs {
+		name := strings.TrimSuffix(filepath.Base(input), ".input.json")
+		t.Run(name, func(t *testing.T) {
+			original, err := os.ReadFile(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := orderedjson.Rewrite(original, transform)
+			if err != nil {
+				t.Fatalf("rewrite: %v", err)
+			}
+
+			golden := strings.TrimSuffix(input, ".input.json") + ".golden.json"
+			if *update {
+				if err := os.WriteFile(golden, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("output differs from %s\ngot:\n%s\nwant:\n%s", golden, got, want)
+			}
+		})
+	}
+}
+
+func TestRemoveOutboundGolden(t *testing.T) {
+	testGolden(t, "v2ray", removeOutbound("RU"))
+}
+
+func TestUpdateOutboundGolden(t *testing.T) {
+	method := "chacha20-ietf-poly1305"
+	host := &remnawave.RawHost{
+		Password: remnawave.Passwords{
+			VlessPassword:  "11111111-2222-3333-4444-555555555555",
+			TrojanPassword: "trojan-secret",
+			SSPassword:     "ss-secret",
+		},
+		PublicKey:       "user-public-key",
+		ShortID:         "abcd",
+		ProtocolOptions: &remnawave.ProtocolOptions{SS: &remnawave.SSOptions{Method: &method}},
+	}
+	testGolden(t, "ru_outbound", updateOutbound("RU", host))
+}
+
+func TestFindRawHost(t *testing.T) {
+	tag := "ru-exit"
+	hosts := []remnawave.RawHost{
+		{Remark: "Germany", DbData: remnawave.DbData{InboundTag: "VLESS_DE"}},
+		{Remark: "Россия", DbData: remnawave.DbData{InboundTag: "VLESS_RU", Tag: &tag}},
+	}
+
+	tests := []struct {
+		match, value string
+		want         int
+	}{
+		{"remark", "Россия", 1},
+		{"tag", "ru-exit", 1},
+		{"inboundTag", "VLESS_DE", 0},
+		{"inboundTag", "VLESS_NL", -1},
+	}
+	for _, tt := range tests {
+		got := findRawHost(hosts, tt.match, tt.value)
+		switch {
+		case tt.want < 0 && got != nil:
+			t.Errorf("findRawHost(%s, %q) = %q, want nil", tt.match, tt.value, got.Remark)
+		case tt.want >= 0 && got != &hosts[tt.want]:
+			t.Errorf("findRawHost(%s, %q) did not return host %d", tt.match, tt.value, tt.want)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package useragent
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Feature is a config feature that only some client versions understand.
+type Feature string
+
+const (
+	Balancer Feature = "balancer"
+	XHTTP    Feature = "xhttp"
+)
+
+// allFeatures lists every Feature in the order Features reports them.
+var allFeatures = []Feature{Balancer, XHTTP}
+
+// Capabilities maps a lowercased client name to the minimum version that
+// supports each feature. A known client without an entry for a feature does
+// not support it at all.
+type Capabilities map[string]map[Feature]string
+
+// DefaultCapabilities are used unless the rules file has a "capabilities"
+// object. They are not tied to any client changelog; override them there
+// when a client release says otherwise.
+var DefaultCapabilities = Capabilities{
+	"happ": {
+		Balancer: "1.9",
+		XHTTP:    "1.7",
+	},
+	"streisand": {
+		XHTTP: "1.6",
+	},
+}
+
+var capabilities = DefaultCapabilities
+
+// SetCapabilities replaces the capability matrix, rejecting unknown features
+// and invalid versions.
+func SetCapabilities(matrix Capabilities) error {
+	lowered := make(Capabilities, len(matrix))
+	for name, features := range matrix {
+		for feature, minVersion := range features {
+			if !slices.Contains(allFeatures, feature) {
+				return fmt.Errorf("capabilities %s: unknown feature %s", name, feature)
+			}
+			if _, ok := ParseVersion(minVersion); !ok {
+				return fmt.Errorf("capabilities %s: invalid version %q for %s", name, minVersion, feature)
+			}
+		}
+		lowered[strings.ToLower(name)] = features
+	}
+	capabilities = lowered
+	return nil
+}
+
+// Client is what could be read from a User-Agent like "Happ/1.9.2/ios".
+// A bare number, as in "Streisand/250 CFNetwork/1494.0.7", is a build number
+// and goes to Build instead of Version.
+type Client struct {
+	Name     string
+	Version  string
+	Build    string
+	Platform string
+}
+
+var (
+	clientPattern   = regexp.MustCompile(`([A-Za-z][A-Za-z0-9_-]*)/v?(\d+(?:\.\d+)*)`)
+	namePattern     = regexp.MustCompile(`^\s*([A-Za-z][A-Za-z0-9_-]*)`)
+	platformPattern = regexp.MustCompile(`(?i)\b(ipados|ios|android|windows|macos|linux)\b`)
+)
+
+// Parse extracts the first name/version pair and the platform, if any. Without
+// a pair the leading name is taken, so a bare "Happ" is still known.
+func Parse(userAgent string) Client {
+	var client Client
+	if groups := clientPattern.FindStringSubmatch(userAgent); groups != nil {
+		client.Name = groups[1]
+		if strings.Contains(groups[2], ".") {
+			client.Version = groups[2]
+		} else {
+			client.Build = groups[2]
+		}
+	} else if groups := namePattern.FindStringSubmatch(userAgent); groups != nil {
+		client.Name = groups[1]
+	}
+	if groups := platformPattern.FindStringSubmatch(userAgent); groups != nil {
+		client.Platform = strings.ToLower(groups[1])
+	}
+	return client
+}
+
+// Supports reports whether the client can handle the feature. Clients missing
+// from the capability matrix are not restricted, and neither are known ones
+// that only report a build number, which can't be compared with the minimum
+// versions.
+func (c Client) Supports(feature Feature) bool {
+	features, known := capabilities[strings.ToLower(c.Name)]
+	if !known || (c.Version == "" && c.Build != "") {
+		return true
+	}
+
+	minVersion, ok := features[feature]
+	if !ok {
+		return false
+	}
+
+	version, ok := ParseVersion(c.Version)
+	if !ok {
+		return false
+	}
+	required, _ := ParseVersion(minVersion)
+	return CompareVersions(version, required) >= 0
+}
+
+// Features returns the features the client supports. Clients with the same
+// name and features get the same configs.
+func (c Client) Features() []Feature {
+	var supported []Feature
+	for _, feature := range allFeatures {
+		if c.Supports(feature) {
+			supported = append(supported, feature)
+		}
+	}
+	return supported
+}
@@ -0,0 +1,74 @@
+package useragent
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		userAgent string
+		want      Client
+	}{
+		{happUA, Client{Name: "Happ", Version: "1.9.2", Platform: "ios"}},
+		{oldHappUA, Client{Name: "Happ", Version: "1.8.4", Platform: "android"}},
+		{"Happ", Client{Name: "Happ"}},
+		{streisandUA, Client{Name: "Streisand", Build: "250"}},
+		{"Streisand/v1.6.3", Client{Name: "Streisand", Version: "1.6.3"}},
+		{browserUA, Client{Name: "Mozilla", Version: "5.0", Platform: "windows"}},
+		{"", Client{}},
+	}
+	for _, tt := range tests {
+		if got := Parse(tt.userAgent); got != tt.want {
+			t.Errorf("Parse(%q) = %+v, want %+v", tt.userAgent, got, tt.want)
+		}
+	}
+}
+
+func TestSupports(t *testing.T) {
+	tests := []struct {
+		userAgent string
+		feature   Feature
+		want      bool
+	}{
+		{happUA, Balancer, true},
+		{happUA, XHTTP, true},
+		{oldHappUA, Balancer, false},
+		{oldHappUA, XHTTP, true},
+		{"Happ/1.6/ios", XHTTP, false},
+		{"Happ", Balancer, false},
+		{streisandUA, XHTTP, true},
+		{streisandUA, Balancer, true},
+		{"Streisand/1.5.1", XHTTP, false},
+		{"Streisand/1.6", Balancer, false},
+		{browserUA, Balancer, true},
+	}
+	for _, tt := range tests {
+		if got := Parse(tt.userAgent).Supports(tt.feature); got != tt.want {
+			t.Errorf("Parse(%q).Supports(%s) = %v, want %v", tt.userAgent, tt.feature, got, tt.want)
+		}
+	}
+}
+
+func TestSetCapabilities(t *testing.T) {
+	t.Cleanup(func() { capabilities = DefaultCapabilities })
+
+	if err := SetCapabilities(Capabilities{"Happ": {Balancer: "2.0"}}); err != nil {
+		t.Fatal(err)
+	}
+	if (Client{Name: "Happ", Version: "1.9.2"}).Supports(Balancer) {
+		t.Error("Happ 1.9.2 supports balancer after raising the minimum to 2.0")
+	}
+	if (Client{Name: "Happ", Version: "2.0"}).Supports(XHTTP) {
+		t.Error("Happ supports xhttp without an entry for it")
+	}
+	if !(Client{Name: "Streisand", Version: "1.0"}).Supports(XHTTP) {
+		t.Error("Streisand is restricted after leaving the matrix")
+	}
+
+	for _, matrix := range []Capabilities{
+		{"happ": {"fragment": "1.0"}},
+		{"happ": {Balancer: "latest"}},
+	} {
+		if err := SetCapabilities(matrix); err == nil {
+			t.Errorf("SetCapabilities(%v) = nil, want an error", matrix)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package useragent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Rule selects a handler for User-Agents matching Match. When Version is set
+// the first capture group of Match is compared against it, e.g. ">=1.9".
+// Requires names a feature flag that must be on for the rule to apply.
+type Rule struct {
+	Name     string            `json:"name"`
+	Match    string            `json:"match"`
+	Version  string            `json:"version,omitempty"`
+	Requires string            `json:"requires,omitempty"`
+	Handler  string            `json:"handler"`
+	Headers  map[string]string `json:"headers,omitempty"`
+
+	pattern    *regexp.Regexp
+	constraint *constraint
+}
+
+// DefaultRules mirror the built-in routing used when no rules file is found.
+var DefaultRules = []Rule{
+	{Name: "browser", Match: "Mozilla|Chrome|Safari|Firefox|Opera|Edge|TelegramBot", Handler: "web"},
+	{Name: "sing-box", Match: "(?i)sing-box|hiddify|karing|nekobox", Handler: "sing-box"},
+	{Name: "mihomo", Match: "(?i)clash-verge|flclash|stash", Handler: "mihomo"},
+	{Name: "streisand", Match: "Streisand", Handler: "v2ray-json"},
+	{Name: "happ-balancer", Match: "Happ", Requires: "balancer", Handler: "balancer"},
+	{Name: "happ-json", Match: "Happ", Requires: "happ-json", Handler: "happ-json"},
+}
+
+// Compile prepares the rules for matching, rejecting invalid patterns and
+// version constraints.
+func Compile(rules []Rule) ([]Rule, error) {
+	compiled := make([]Rule, len(rules))
+	for i, rule := range rules {
+		if rule.Match == "" || rule.Handler == "" {
+			return nil, fmt.Errorf("rule %d (%s): match and handler are required", i+1, rule.Name)
+		}
+
+		pattern, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d (%s): %w", i+1, rule.Name, err)
+		}
+		rule.pattern = pattern
+
+		if rule.Version != "" {
+			if pattern.NumSubexp() == 0 {
+				return nil, fmt.Errorf("rule %d (%s): version constraint needs a capture group in match", i+1, rule.Name)
+			}
+			rule.constraint, err = parseConstraint(rule.Version)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d (%s): %w", i+1, rule.Name, err)
+			}
+		}
+		compiled[i] = rule
+	}
+	return compiled, nil
+}
+
+// ruleFile is the object form of the rules file, which can replace the
+// capability matrix next to the rules.
+type ruleFile struct {
+	Capabilities Capabilities `json:"capabilities"`
+	Rules        []Rule       `json:"rules"`
+}
+
+// LoadRules reads an ordered JSON list of rules from path. The file is either
+// that list or an object with "rules" and an optional "capabilities" matrix,
+// which is returned as nil when absent.
+func LoadRules(path string) ([]Rule, Capabilities, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var file ruleFile
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(data, &file.Rules)
+	} else {
+		err = json.Unmarshal(data, &file)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("decoding %s: %w", path, err)
+	}
+
+	rules, err := Compile(file.Rules)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rules, file.Capabilities, nil
+}
+
+// Matches reports whether the User-Agent matches the rule pattern and, if
+// set, its version constraint.
+func (r Rule) Matches(userAgent string) bool {
+	if r.pattern == nil {
+		return false
+	}
+	if r.constraint == nil {
+		return r.pattern.MatchString(userAgent)
+	}
+
+	groups := r.pattern.FindStringSubmatch(userAgent)
+	if groups == nil {
+		return false
+	}
+	return r.constraint.allows(groups[1])
+}
+
+type constraint struct {
+	op      string
+	version []int
+}
+
+func parseConstraint(value string) (*constraint, error) {
+	value = strings.TrimSpace(value)
+	op := "="
+	for _, candidate := range []string{">=", "<=", "!=", "==", ">", "<", "="} {
+		if strings.HasPrefix(value, candidate) {
+			op = candidate
+			value = strings.TrimSpace(value[len(candidate):])
+			break
+		}
+	}
+
+	version, ok := ParseVersion(value)
+	if !ok {
+		return nil, fmt.Errorf("invalid version %q", value)
+	}
+	return &constraint{op: op, version: version}, nil
+}
+
+func (c *constraint) allows(value string) bool {
+	version, ok := ParseVersion(value)
+	if !ok {
+		return false
+	}
+
+	cmp := CompareVersions(version, c.version)
+	switch c.op {
+	case ">=":
+		return cmp >= 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case "<":
+		return cmp < 0
+	case "!=":
+		return cmp != 0
+	default:
+		return cmp == 0
+	}
+}
+
+// ParseVersion splits a dotted version like "1.9.2" into its numbers.
+func ParseVersion(value string) ([]int, bool) {
+	if value == "" {
+		return nil, false
+	}
+
+	parts := strings.Split(value, ".")
+	version := make([]int, 0, len(parts))
+	for _, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, false
+		}
+		version = append(version, n)
+	}
+	return version, true
+}
+
+// CompareVersions returns -1, 0 or 1, treating missing parts as zero.
+func CompareVersions(a, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,187 @@
+package useragent
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+const (
+	happUA      = "Happ/1.9.2/ios"
+	oldHappUA   = "Happ/1.8.4/android"
+	streisandUA = "Streisand/250 CFNetwork/1494.0.7 Darwin/23.4.0"
+	browserUA   = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []int
+		ok    bool
+	}{
+		{"1.9.2", []int{1, 9, 2}, true},
+		{"250", []int{250}, true},
+		{"1494.0.7", []int{1494, 0, 7}, true},
+		{"", nil, false},
+		{"1..2", nil, false},
+		{"1.9b", nil, false},
+		{"v1.9", nil, false},
+	}
+	for _, tt := range tests {
+		got, ok := ParseVersion(tt.value)
+		if ok != tt.ok || !slices.Equal(got, tt.want) {
+			t.Errorf("ParseVersion(%q) = %v, %v, want %v, %v", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b []int
+		want int
+	}{
+		{[]int{1, 9}, []int{1, 9}, 0},
+		{[]int{1, 9}, []int{1, 9, 0}, 0},
+		{[]int{1, 9, 2}, []int{1, 9}, 1},
+		{[]int{1, 10}, []int{1, 9}, 1},
+		{[]int{1, 8, 9}, []int{1, 9}, -1},
+		{[]int{2}, []int{1, 99}, 1},
+		{nil, []int{0}, 0},
+	}
+	for _, tt := range tests {
+		if got := CompareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("CompareVersions(%v, %v) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestParseConstraint(t *testing.T) {
+	tests := []struct {
+		value   string
+		op      string
+		version []int
+		wantErr bool
+	}{
+		{">=1.9", ">=", []int{1, 9}, false},
+		{"> 1.9.2", ">", []int{1, 9, 2}, false},
+		{"<=2", "<=", []int{2}, false},
+		{"!=1.8", "!=", []int{1, 8}, false},
+		{"==1.7", "==", []int{1, 7}, false},
+		{"1.7", "=", []int{1, 7}, false},
+		{" >= 1.9 ", ">=", []int{1, 9}, false},
+		{">=", "", nil, true},
+		{"~1.9", "", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseConstraint(tt.value)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseConstraint(%q) = %+v, want error", tt.value, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseConstraint(%q) error: %v", tt.value, err)
+			continue
+		}
+		if got.op != tt.op || !slices.Equal(got.version, tt.version) {
+			t.Errorf("parseConstraint(%q) = %s %v, want %s %v", tt.value, got.op, got.version, tt.op, tt.version)
+		}
+	}
+}
+
+func TestRuleMatches(t *testing.T) {
+	rules, err := Compile([]Rule{
+		{Name: "happ-balancer", Match: `Happ/([\d.]+)`, Version: ">=1.9", Handler: "balancer"},
+		{Name: "happ", Match: "Happ", Handler: "happ-json"},
+		{Name: "streisand", Match: `Streisand/(\d+)`, Version: ">=200", Handler: "v2ray-json"},
+		{Name: "browser", Match: "Mozilla|Chrome", Handler: "web"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		userAgent string
+		want      string
+	}{
+		{happUA, "happ-balancer"},
+		{"Happ/1.10/ios", "happ-balancer"},
+		{oldHappUA, "happ"},
+		{"Happ", "happ"},
+		{streisandUA, "streisand"},
+		{"Streisand/120 CFNetwork/1410.0.3 Darwin/22.6.0", ""},
+		{browserUA, "browser"},
+		{"curl/8.5.0", ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		for _, rule := range rules {
+			if rule.Matches(tt.userAgent) {
+				got = rule.Name
+				break
+			}
+		}
+		if got != tt.want {
+			t.Errorf("first rule matching %q = %q, want %q", tt.userAgent, got, tt.want)
+		}
+	}
+}
+
+func TestCompileRejects(t *testing.T) {
+	tests := []Rule{
+		{Name: "no handler", Match: "Happ"},
+		{Name: "bad pattern", Match: "Happ(", Handler: "happ-json"},
+		{Name: "no group", Match: "Happ", Version: ">=1.9", Handler: "balancer"},
+		{Name: "bad version", Match: `Happ/([\d.]+)`, Version: ">=new", Handler: "balancer"},
+	}
+	for _, rule := range tests {
+		if _, err := Compile([]Rule{rule}); err == nil {
+			t.Errorf("Compile(%s) = nil error, want error", rule.Name)
+		}
+	}
+}
+
+func TestLoadRules(t *testing.T) {
+	tests := []struct {
+		name             string
+		data             string
+		wantCapabilities Capabilities
+	}{
+		{"list", `[{"name": "happ", "match": "Happ", "handler": "balancer"}]`, nil},
+		{"object", `{"capabilities": {"Happ": {"balancer": "2.0"}}, "rules": [{"name": "happ", "match": "Happ", "handler": "balancer"}]}`, Capabilities{"Happ": {Balancer: "2.0"}}},
+		{"object without capabilities", `{"rules": [{"name": "happ", "match": "Happ", "handler": "balancer"}]}`, nil},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "user_agents.json")
+		if err := os.WriteFile(path, []byte(tt.data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		rules, capabilities, err := LoadRules(path)
+		if err != nil {
+			t.Fatalf("%s: LoadRules() error = %v", tt.name, err)
+		}
+		if len(rules) != 1 || !rules[0].Matches(happUA) {
+			t.Errorf("%s: rules = %+v, want the happ rule", tt.name, rules)
+		}
+		if !reflect.DeepEqual(capabilities, tt.wantCapabilities) {
+			t.Errorf("%s: capabilities = %v, want %v", tt.name, capabilities, tt.wantCapabilities)
+		}
+	}
+}
+
+func TestLoadRulesTemplate(t *testing.T) {
+	rules, capabilities, err := LoadRules("../../templates/user_agents.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) == 0 {
+		t.Error("no rules loaded")
+	}
+	if !reflect.DeepEqual(capabilities, DefaultCapabilities) {
+		t.Errorf("template capabilities = %v, want the defaults %v", capabilities, DefaultCapabilities)
+	}
+}
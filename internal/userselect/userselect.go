@@ -0,0 +1,70 @@
+// Package userselect matches panel users against the selectors of rule sets,
+// v2ray-json patches and Happ routing profiles.
+//
+// Every selector follows the same rule: each non-empty field must match, a
+// field matching when the user has any of its values. An empty selector
+// matches everyone.
+package userselect
+
+import "strings"
+
+// User is what selectors are matched against. Client is the name parsed from
+// the User-Agent.
+type User struct {
+	ShortUuid string
+	Username  string
+	Tag       string
+	Squads    []string
+	Client    string
+}
+
+// Selector picks users by shortUuid, username, user tag, internal squad name
+// and client, the latter compared case-insensitively.
+type Selector struct {
+	ShortUuids []string `json:"shortUuids,omitempty" yaml:"shortUuids"`
+	Usernames  []string `json:"usernames,omitempty" yaml:"usernames"`
+	Tags       []string `json:"tags,omitempty" yaml:"tags"`
+	Squads     []string `json:"squads,omitempty" yaml:"squads"`
+	Clients    []string `json:"clients,omitempty" yaml:"clients"`
+}
+
+func (s Selector) Matches(u User) bool {
+	return matchField(s.ShortUuids, false, u.ShortUuid) &&
+		matchField(s.Usernames, false, u.Username) &&
+		matchField(s.Tags, false, u.Tag) &&
+		matchField(s.Squads, false, u.Squads...) &&
+		matchField(s.Clients, true, u.Client)
+}
+
+func (s Selector) IsEmpty() bool {
+	return len(s.ShortUuids) == 0 && len(s.Usernames) == 0 && len(s.Tags) == 0 && len(s.Squads) == 0 && len(s.Clients) == 0
+}
+
+// NeedsUser reports whether matching takes more than the shortUuid and
+// client, i.e. whether the user has to be fetched from the panel first.
+func (s Selector) NeedsUser() bool {
+	return len(s.Usernames) > 0 || len(s.Tags) > 0 || len(s.Squads) > 0
+}
+
+func matchField(list []string, foldCase bool, values ...string) bool {
+	return len(list) == 0 || containsAny(list, foldCase, values...)
+}
+
+// ContainsAny reports whether list holds any of the non-empty values.
+func ContainsAny(list []string, values ...string) bool {
+	return containsAny(list, false, values...)
+}
+
+func containsAny(list []string, foldCase bool, values ...string) bool {
+	for _, item := range list {
+		for _, value := range values {
+			if value == "" {
+				continue
+			}
+			if item == value || foldCase && strings.EqualFold(item, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
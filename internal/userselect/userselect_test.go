@@ -0,0 +1,75 @@
+package userselect
+
+import "testing"
+
+func TestSelectorMatches(t *testing.T) {
+	user := User{
+		ShortUuid: "c11JfduMqrkBZrTZ",
+		Username:  "acme",
+		Tag:       "VIP",
+		Squads:    []string{"Default", "Kazakhstan"},
+		Client:    "Happ",
+	}
+
+	tests := []struct {
+		name     string
+		selector Selector
+		want     bool
+	}{
+		{"empty matches everyone", Selector{}, true},
+		{"shortUuid", Selector{ShortUuids: []string{"other", "c11JfduMqrkBZrTZ"}}, true},
+		{"other shortUuid", Selector{ShortUuids: []string{"other"}}, false},
+		{"username", Selector{Usernames: []string{"acme"}}, true},
+		{"username is case-sensitive", Selector{Usernames: []string{"ACME"}}, false},
+		{"tag", Selector{Tags: []string{"VIP"}}, true},
+		{"other tag", Selector{Tags: []string{"KZ"}}, false},
+		{"any squad", Selector{Squads: []string{"Kazakhstan"}}, true},
+		{"no squad", Selector{Squads: []string{"Russia"}}, false},
+		{"client ignores case", Selector{Clients: []string{"happ"}}, true},
+		{"other client", Selector{Clients: []string{"Streisand"}}, false},
+		{"every field must match", Selector{Tags: []string{"VIP"}, Squads: []string{"Russia"}}, false},
+		{"all fields match", Selector{Tags: []string{"VIP"}, Squads: []string{"Kazakhstan"}, Clients: []string{"HAPP"}}, true},
+	}
+	for _, tt := range tests {
+		if got := tt.selector.Matches(user); got != tt.want {
+			t.Errorf("%s: Matches() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSelectorMatchesEmptyUser(t *testing.T) {
+	if (Selector{Tags: []string{""}}).Matches(User{}) {
+		t.Error("an empty tag matched a user without a tag")
+	}
+	if (Selector{Squads: []string{"Default"}}).Matches(User{}) {
+		t.Error("a squad matched a user without squads")
+	}
+}
+
+func TestSelectorNeedsUser(t *testing.T) {
+	tests := []struct {
+		selector Selector
+		want     bool
+	}{
+		{Selector{}, false},
+		{Selector{ShortUuids: []string{"c11JfduMqrkBZrTZ"}}, false},
+		{Selector{Clients: []string{"Happ"}}, false},
+		{Selector{Usernames: []string{"acme"}}, true},
+		{Selector{Tags: []string{"VIP"}}, true},
+		{Selector{Squads: []string{"Kazakhstan"}}, true},
+	}
+	for _, tt := range tests {
+		if got := tt.selector.NeedsUser(); got != tt.want {
+			t.Errorf("%+v.NeedsUser() = %v, want %v", tt.selector, got, tt.want)
+		}
+	}
+}
+
+func TestContainsAny(t *testing.T) {
+	if !ContainsAny([]string{"KZ", "VIP"}, "RU", "VIP") {
+		t.Error("ContainsAny missed a listed value")
+	}
+	if ContainsAny([]string{"KZ"}, "kz", "") {
+		t.Error("ContainsAny matched a different case or an empty value")
+	}
+}